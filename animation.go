@@ -0,0 +1,443 @@
+package systray
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"sync"
+	"time"
+)
+
+const (
+	// minAnimationInterval throttles the animations to 20 frames per second at most
+	minAnimationInterval = 50 * time.Millisecond
+	// defaultAnimationDelay is used for the GIF and APNG frames without the delay
+	defaultAnimationDelay = 100 * time.Millisecond
+)
+
+// Animation plays the tray icon frames in a loop until it's stopped, another animation or icon is set
+// or the tray quits. The playback pauses while the tray status is StatusPassive (Linux).
+// Its methods are safe for concurrent use.
+type Animation struct {
+	tray   *Tray
+	frames []iconFrame
+	delays []time.Duration
+
+	lock   sync.Mutex
+	paused bool
+	// wake resumes the playback paused by Pause or by the passive status
+	wake chan struct{}
+	stop chan struct{}
+}
+
+// SetIconAnimation plays the icon frames changing them every interval. The frames are decoded
+// once, their content is the same as SetIcon takes. The interval is at least 50ms.
+// The returned error wraps ErrBadIcon when a frame can't be decoded, the current animation
+// keeps playing then.
+func SetIconAnimation(frames [][]byte, interval time.Duration) (*Animation, error) {
+	return defaultTray.SetIconAnimation(frames, interval)
+}
+
+// SetIconAnimation plays the icon frames, see the package level SetIconAnimation.
+func (t *Tray) SetIconAnimation(frames [][]byte, interval time.Duration) (*Animation, error) {
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("%w: no animation frames", ErrBadIcon)
+	}
+	decoded := make([]iconFrame, len(frames))
+	delays := make([]time.Duration, len(frames))
+	for i, data := range frames {
+		frame, err := decodeFrame(data)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %w", i, err)
+		}
+		decoded[i] = frame
+		delays[i] = interval
+	}
+	return t.playAnimation(decoded, delays), nil
+}
+
+// SetAnimatedIcon plays the animated GIF or APNG icon with the frame delays it has.
+// A PNG without animation is played as the single frame. The delays are at least 50ms.
+// The returned error wraps ErrBadIcon when the icon can't be decoded.
+func SetAnimatedIcon(data []byte) (*Animation, error) {
+	return defaultTray.SetAnimatedIcon(data)
+}
+
+// SetAnimatedIcon plays the animated GIF or APNG icon, see the package level SetAnimatedIcon.
+func (t *Tray) SetAnimatedIcon(data []byte) (*Animation, error) {
+	images, delays, err := decodeAnimation(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadIcon, err)
+	}
+	frames := make([]iconFrame, len(images))
+	for i, img := range images {
+		if frames[i], err = imageFrame(img); err != nil {
+			return nil, fmt.Errorf("frame %d: %w", i, err)
+		}
+	}
+	return t.playAnimation(frames, delays), nil
+}
+
+// playAnimation replaces the current animation of the tray by the new one
+func (t *Tray) playAnimation(frames []iconFrame, delays []time.Duration) *Animation {
+	for i, delay := range delays {
+		delays[i] = max(delay, minAnimationInterval)
+	}
+	a := &Animation{
+		tray:   t,
+		frames: frames,
+		delays: delays,
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}
+	t.animationLock.Lock()
+	if t.animation != nil {
+		t.animation.Stop()
+	}
+	t.animation = a
+	t.animationLock.Unlock()
+	go a.run()
+	return a
+}
+
+// stopAnimation stops the current animation of the tray
+func (t *Tray) stopAnimation() {
+	t.animationLock.Lock()
+	defer t.animationLock.Unlock()
+	if t.animation != nil {
+		t.animation.Stop()
+		t.animation = nil
+	}
+}
+
+// statusChanged resumes the animation paused by the passive status
+func (t *Tray) statusChanged() {
+	t.animationLock.Lock()
+	defer t.animationLock.Unlock()
+	if t.animation != nil {
+		t.animation.wakeUp()
+	}
+}
+
+func (a *Animation) run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	next := 0
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-timer.C:
+		}
+		for a.isPaused() || a.tray.passive() {
+			select {
+			case <-a.stop:
+				return
+			case <-a.wake:
+			}
+		}
+		delay := a.delays[next]
+		if a.showFrame(next) {
+			next = (next + 1) % len(a.frames)
+		}
+		timer.Reset(delay)
+	}
+}
+
+// showFrame shows the frame unless the animation has been paused or stopped meanwhile,
+// so no frame is shown after Pause or Stop returns.
+// The passive tray isn't shown, so the playback waits for the status change then.
+func (a *Animation) showFrame(frame int) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	select {
+	case <-a.stop:
+		return false
+	default:
+	}
+	if a.paused || a.tray.passive() {
+		return false
+	}
+	if err := a.tray.showFrame(a.frames[frame]); err != nil {
+		logger().Warn("failed to show animation frame", append([]any{"frame", frame}, errorAttrs(err)...)...)
+	}
+	return true
+}
+
+func (a *Animation) isPaused() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.paused
+}
+
+// Pause pauses the playback at the current frame.
+// The icon isn't changed by the animation after Pause returns.
+func (a *Animation) Pause() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.paused = true
+}
+
+// Resume resumes the paused playback.
+func (a *Animation) Resume() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.paused {
+		a.paused = false
+		a.wakeUp()
+	}
+}
+
+// wakeUp makes the paused playback check if it can go on
+func (a *Animation) wakeUp() {
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Stop stops the playback, the icon stays at the current frame.
+// The icon isn't changed by the animation after Stop returns.
+func (a *Animation) Stop() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	select {
+	case <-a.stop:
+	default:
+		close(a.stop)
+	}
+}
+
+// decodeAnimation decodes the frames of the animated GIF or APNG into full size images
+func decodeAnimation(data []byte) ([]image.Image, []time.Duration, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return decodeGIFAnimation(data)
+	case bytes.HasPrefix(data, []byte(pngSignature)):
+		return decodeAPNG(data)
+	}
+	return nil, nil, errors.New("not a GIF or PNG animation")
+}
+
+func decodeGIFAnimation(data []byte) ([]image.Image, []time.Duration, error) {
+	config, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	if config.Width > maxIconSize || config.Height > maxIconSize {
+		return nil, nil, fmt.Errorf("gif: bad size %dx%d", config.Width, config.Height)
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	canvas := image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	frames := make([]image.Image, len(g.Image))
+	delays := make([]time.Duration, len(g.Image))
+	for i, frame := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			previous = cloneNRGBA(canvas)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		frames[i] = cloneNRGBA(canvas)
+		delays[i] = defaultAnimationDelay
+		if i < len(g.Delay) && g.Delay[i] > 0 {
+			delays[i] = time.Duration(g.Delay[i]) * 10 * time.Millisecond
+		}
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames, delays, nil
+}
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// pngChunk is the chunk of PNG file
+type pngChunk struct {
+	typ  string
+	data []byte
+}
+
+// apngFrame is the frame control of APNG with the frame image data
+type apngFrame struct {
+	width, height, x, y int
+	delay               time.Duration
+	dispose, blend      byte
+	data                [][]byte
+}
+
+// APNG dispose and blend operations
+const (
+	apngDisposeBackground = 1
+	apngDisposePrevious   = 2
+	apngBlendOver         = 1
+)
+
+// decodeAPNG decodes the frames of APNG, every frame is decoded as PNG made of the frame
+// data and the chunks of the animation header, then the frames are composed like GIF frames
+func decodeAPNG(data []byte) ([]image.Image, []time.Duration, error) {
+	chunks, err := readPNGChunks(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	var header []pngChunk
+	var frames []*apngFrame
+	var frame *apngFrame
+	animated, afterIDAT := false, false
+	for _, c := range chunks {
+		switch c.typ {
+		case "acTL":
+			animated = true
+		case "fcTL":
+			if len(c.data) < 26 {
+				return nil, nil, errors.New("apng: bad fcTL chunk")
+			}
+			be := binary.BigEndian
+			frame = &apngFrame{
+				width:   int(be.Uint32(c.data[4:])),
+				height:  int(be.Uint32(c.data[8:])),
+				x:       int(be.Uint32(c.data[12:])),
+				y:       int(be.Uint32(c.data[16:])),
+				delay:   defaultAnimationDelay,
+				dispose: c.data[24],
+				blend:   c.data[25],
+			}
+			if num, den := be.Uint16(c.data[20:]), be.Uint16(c.data[22:]); num > 0 {
+				if den == 0 {
+					den = 100
+				}
+				frame.delay = time.Duration(num) * time.Second / time.Duration(den)
+			}
+			frames = append(frames, frame)
+		case "IDAT":
+			afterIDAT = true
+			// the default image is the first frame only when its fcTL precedes IDAT
+			if frame != nil {
+				frame.data = append(frame.data, c.data)
+			}
+		case "fdAT":
+			if frame == nil || len(c.data) < 4 {
+				return nil, nil, errors.New("apng: bad fdAT chunk")
+			}
+			frame.data = append(frame.data, c.data[4:])
+		case "IEND":
+		default:
+			if !afterIDAT {
+				header = append(header, c)
+			}
+		}
+	}
+	if len(header) == 0 || header[0].typ != "IHDR" || len(header[0].data) < 8 {
+		return nil, nil, errors.New("apng: no IHDR chunk")
+	}
+	width, height := binary.BigEndian.Uint32(header[0].data), binary.BigEndian.Uint32(header[0].data[4:])
+	if width == 0 || height == 0 || width > maxIconSize || height > maxIconSize {
+		return nil, nil, fmt.Errorf("apng: bad size %dx%d", width, height)
+	}
+	if !animated || len(frames) == 0 {
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, err
+		}
+		return []image.Image{img}, []time.Duration{defaultAnimationDelay}, nil
+	}
+	canvas := image.NewNRGBA(image.Rect(0, 0, int(width), int(height)))
+
+	var images []image.Image
+	var delays []time.Duration
+	for i, f := range frames {
+		if len(f.data) == 0 {
+			continue
+		}
+		bounds := image.Rect(f.x, f.y, f.x+f.width, f.y+f.height)
+		if bounds.Empty() || !bounds.In(canvas.Rect) {
+			return nil, nil, fmt.Errorf("apng: frame %d is out of the image", i)
+		}
+		img, err := png.Decode(bytes.NewReader(framePNG(header, f)))
+		if err != nil {
+			return nil, nil, fmt.Errorf("apng: frame %d: %w", i, err)
+		}
+		var previous *image.NRGBA
+		if f.dispose == apngDisposePrevious {
+			previous = cloneNRGBA(canvas)
+		}
+		op := draw.Src
+		if f.blend == apngBlendOver {
+			op = draw.Over
+		}
+		draw.Draw(canvas, bounds, img, img.Bounds().Min, op)
+		images = append(images, cloneNRGBA(canvas))
+		delays = append(delays, f.delay)
+		switch f.dispose {
+		case apngDisposeBackground:
+			draw.Draw(canvas, bounds, image.Transparent, image.Point{}, draw.Src)
+		case apngDisposePrevious:
+			canvas = previous
+		}
+	}
+	if len(images) == 0 {
+		return nil, nil, errors.New("apng: no frames")
+	}
+	return images, delays, nil
+}
+
+// readPNGChunks splits PNG into chunks, the CRC is checked later by png.Decode
+func readPNGChunks(data []byte) ([]pngChunk, error) {
+	data = data[len(pngSignature):]
+	var chunks []pngChunk
+	for len(data) > 0 {
+		if len(data) < 12 {
+			return nil, errors.New("png: truncated chunk")
+		}
+		size := int64(binary.BigEndian.Uint32(data))
+		if size > int64(len(data)-12) {
+			return nil, errors.New("png: truncated chunk")
+		}
+		chunks = append(chunks, pngChunk{typ: string(data[4:8]), data: data[8 : 8+size]})
+		data = data[12+size:]
+	}
+	return chunks, nil
+}
+
+// framePNG makes PNG of the APNG frame with the header chunks resized to the frame
+func framePNG(header []pngChunk, f *apngFrame) []byte {
+	buf := []byte(pngSignature)
+	write := func(typ string, data []byte) {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
+		start := len(buf)
+		buf = append(buf, typ...)
+		buf = append(buf, data...)
+		buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf[start:]))
+	}
+	ihdr := bytes.Clone(header[0].data)
+	binary.BigEndian.PutUint32(ihdr, uint32(f.width))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(f.height))
+	write("IHDR", ihdr)
+	for _, c := range header[1:] {
+		write(c.typ, c.data)
+	}
+	write("IDAT", bytes.Join(f.data, nil))
+	write("IEND", nil)
+	return buf
+}
+
+func cloneNRGBA(img *image.NRGBA) *image.NRGBA {
+	clone := *img
+	clone.Pix = bytes.Clone(img.Pix)
+	return &clone
+}
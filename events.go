@@ -0,0 +1,229 @@
+package systray
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// EventType is the kind of an Event
+type EventType int
+
+const (
+	// EventClick is sent when a menu item is clicked
+	EventClick EventType = iota + 1
+	// EventActivate is sent when the tray icon is activated (usually by the left click), only available on Linux
+	EventActivate
+	// EventSecondaryActivate is sent on the secondary activation of the tray icon (usually by the middle click), only available on Linux
+	EventSecondaryActivate
+	// EventScroll is sent when the mouse wheel is scrolled over the tray icon, only available on Linux
+	EventScroll
+	// EventMenuOpened is sent when the menu or a sub menu is shown, only available on Linux
+	EventMenuOpened
+	// EventMenuClosed is sent when the menu or a sub menu is hidden, only available on Linux
+	EventMenuClosed
+	// EventRegistered is sent when the registration state changes to StateRegistered or StateNoHost
+	EventRegistered
+	// EventUnregistered is sent when the registration state changes to StateUnregistered or StateNoWatcher,
+	// because the registration has failed, the watcher or the connection is lost or the tray quits
+	EventUnregistered
+	// EventQuit is sent when the systray quits
+	EventQuit
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventClick:
+		return "Click"
+	case EventActivate:
+		return "Activate"
+	case EventSecondaryActivate:
+		return "SecondaryActivate"
+	case EventScroll:
+		return "Scroll"
+	case EventMenuOpened:
+		return "MenuOpened"
+	case EventMenuClosed:
+		return "MenuClosed"
+	case EventRegistered:
+		return "Registered"
+	case EventUnregistered:
+		return "Unregistered"
+	case EventQuit:
+		return "Quit"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event is an event of the systray delivered by Events
+type Event struct {
+	Type EventType
+	// ItemID is the ID of the clicked menu item for EventClick or the ID of the
+	// opened/closed sub menu parent for EventMenuOpened and EventMenuClosed (0 for the root menu)
+	ItemID uint32
+	// Item is the menu item with ItemID, nil for the root menu
+	Item *MenuItem
+	// Timestamp is the time of the event reported by the host, only available on Linux
+	Timestamp uint32
+	// Data is the value of the event data sent by the host with the menu event, only available on Linux
+	Data interface{}
+	// X and Y are the screen coordinates of EventActivate and EventSecondaryActivate
+	X, Y int
+	// Delta is the scroll amount of EventScroll
+	Delta int
+	// Orientation is the scroll orientation of EventScroll: "horizontal" or "vertical"
+	Orientation string
+	// State is the new registration state of EventRegistered and EventUnregistered
+	State RegistrationState
+	// Err is the reason of EventUnregistered, nil when the tray quits
+	Err error
+	// Dropped is the number of events dropped right before this one due to the channel overflow
+	Dropped uint64
+}
+
+// OverflowPolicy defines which event is dropped when the events channel is full
+type OverflowPolicy int
+
+const (
+	// DropNewest drops the new event when the channel is full
+	DropNewest OverflowPolicy = iota
+	// DropOldest drops the oldest unread event from the channel to free the room for the new one
+	DropOldest
+)
+
+// DefaultEventBuffer is the default buffer size of the events channel
+const DefaultEventBuffer = 64
+
+// EventsOption configures the events channel returned by Events
+type EventsOption func(*subscriber)
+
+// WithEventBuffer sets the buffer size of the events channel
+func WithEventBuffer(size int) EventsOption {
+	return func(s *subscriber) {
+		s.size = max(size, 0)
+	}
+}
+
+// WithOverflowPolicy sets the policy to apply when the events channel is full, DropNewest is the default one
+func WithOverflowPolicy(policy OverflowPolicy) EventsOption {
+	return func(s *subscriber) {
+		s.policy = policy
+	}
+}
+
+// Events returns a channel delivering all events of the systray: menu clicks, tray icon activation
+// and scrolling, menu opening and closing, registration changes and quit.
+// The channel is closed when ctx is cancelled.
+// Events are never blocked by a slow reader: when the channel buffer is full the events are
+// dropped according to the overflow policy, and the number of dropped events is reported
+// in the Dropped field of the next delivered event.
+//
+// On Linux, the tray icon activation is handled only while somebody listens to the events,
+// otherwise the host gets the unknown method error for Activate and SecondaryActivate
+// and falls back to showing the menu.
+func Events(ctx context.Context, opts ...EventsOption) <-chan Event {
+	return defaultTray.Events(ctx, opts...)
+}
+
+// Events returns a channel delivering all events of the tray, see the package level Events.
+func (t *Tray) Events(ctx context.Context, opts ...EventsOption) <-chan Event {
+	s := &subscriber{size: DefaultEventBuffer, policy: DropNewest}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.ch = make(chan Event, s.size)
+	t.events.subscribe(s)
+	go func() {
+		<-ctx.Done()
+		t.events.unsubscribe(s)
+	}()
+	return s.ch
+}
+
+// eventHub delivers the published events to all subscribers
+type eventHub struct {
+	lock        sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: map[*subscriber]struct{}{}}
+}
+
+type subscriber struct {
+	ch      chan Event
+	size    int
+	policy  OverflowPolicy
+	dropped uint64
+}
+
+func (h *eventHub) subscribe(s *subscriber) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.subscribers[s] = struct{}{}
+}
+
+func (h *eventHub) unsubscribe(s *subscriber) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.subscribers, s)
+	close(s.ch)
+}
+
+// listened checks if there is at least one subscriber
+func (h *eventHub) listened() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.subscribers) > 0
+}
+
+// publish sends the event to all subscribers, it never blocks
+func (h *eventHub) publish(e Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for s := range h.subscribers {
+		s.send(e)
+	}
+}
+
+// send delivers the event according to the overflow policy, it's always called after eventHub.lock.Lock()
+func (s *subscriber) send(e Event) {
+	if s.policy == DropOldest && cap(s.ch) > 0 && len(s.ch) == cap(s.ch) {
+		s.dropOldest()
+	}
+	e.Dropped = s.dropped
+	select {
+	case s.ch <- e:
+		s.dropped = 0
+	default:
+		s.dropped++
+	}
+}
+
+// dropOldest drops the oldest queued event and reports the drop on the next queued one.
+// It's always called after eventHub.lock.Lock(), so no events are queued meanwhile,
+// but the reader can take some of them and free the room.
+func (s *subscriber) dropOldest() {
+	queued := make([]Event, 0, cap(s.ch))
+	for drained := false; !drained; {
+		select {
+		case e := <-s.ch:
+			queued = append(queued, e)
+		default:
+			drained = true
+		}
+	}
+	if len(queued) == cap(s.ch) {
+		dropped := queued[0].Dropped + 1
+		queued = queued[1:]
+		if len(queued) > 0 {
+			queued[0].Dropped += dropped
+		} else {
+			// the new event is the next one delivered
+			s.dropped += dropped
+		}
+	}
+	for _, e := range queued {
+		s.ch <- e
+	}
+}
@@ -14,6 +14,8 @@ func main() {
 		fmt.Println("Exit at", now.String())
 	}
 
+	// call onExit and remove the icon on Ctrl-C as well
+	systray.Configure(systray.WithSignalHandling())
 	systray.Run(onReady, onExit)
 }
 
@@ -42,6 +44,15 @@ func onReady() {
 		systray.SetTooltip("Pretty awesome棒棒嗒")
 		mChange := systray.AddMenuItem("Change Me", "Change Me")
 		mChecked := systray.AddMenuItemCheckbox("Checked", "Check Me", true)
+		// the check mark is toggled by the library itself
+		mChecked.SetAutoToggle(true)
+		mChecked.OnCheckedChanged(func(checked bool) {
+			if checked {
+				mChecked.SetTitle("Checked")
+			} else {
+				mChecked.SetTitle("Unchecked")
+			}
+		})
 		mEnabled := systray.AddMenuItem("Enabled", "Enabled")
 		// Sets the icon of a menu item. Only available on Mac.
 		mEnabled.SetTemplateIcon(icon.Data, icon.Data)
@@ -77,14 +88,6 @@ func onReady() {
 			case <-mChange.ClickedCh:
 				mChange.SetTitle("I've Changed")
 				systray.SetTemplateIcon(icon.Data1, icon.Data1)
-			case <-mChecked.ClickedCh:
-				if mChecked.Checked() {
-					mChecked.Uncheck()
-					mChecked.SetTitle("Unchecked")
-				} else {
-					mChecked.Check()
-					mChecked.SetTitle("Checked")
-				}
 			case <-mEnabled.ClickedCh:
 				mEnabled.SetTitle("Disabled")
 				mEnabled.Disable()
@@ -93,8 +96,11 @@ func onReady() {
 			case <-subMenuBottom.ClickedCh:
 				toggle()
 			case <-mReset.ClickedCh:
-				systray.ResetMenu()
-				addQuitItem()
+				// rebuild the menu in one step to avoid flickering
+				systray.Batch(func() {
+					systray.ResetMenu()
+					addQuitItem()
+				})
 			case <-mToggle.ClickedCh:
 				toggle()
 			}
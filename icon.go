@@ -0,0 +1,80 @@
+package systray
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+)
+
+// maxIconSize is the largest width and height of the decoded DIB and animation frames,
+// the tray icons are much smaller
+const maxIconSize = 1024
+
+// SetIconImage sets the systray icon from the image, so the icons rendered in memory
+// don't have to be encoded. A nil image clears the icon on Linux. The current animation is stopped.
+func SetIconImage(img image.Image) {
+	defaultTray.SetIconImage(img)
+}
+
+// SetIconImage sets the tray icon from the image, see the package level SetIconImage.
+func (t *Tray) SetIconImage(img image.Image) {
+	t.stopAnimation()
+	if err := t.setIconImage(img); err != nil {
+		logger().Error("failed to set icon", errorAttrs(err)...)
+	}
+}
+
+// SetAttentionIconImage sets the icon shown by the host while the status is StatusNeedsAttention,
+// only available on Linux. A nil image clears the attention icon.
+func SetAttentionIconImage(img image.Image) {
+	defaultTray.SetAttentionIconImage(img)
+}
+
+// SetAttentionIconImage sets the attention icon from the image, see the package level SetAttentionIconImage.
+func (t *Tray) SetAttentionIconImage(img image.Image) {
+	if err := t.setAttentionIconImage(img); err != nil {
+		logger().Error("failed to set attention icon", errorAttrs(err)...)
+	}
+}
+
+// SetIconImage sets the icon of a menu item from the image.
+func (item *MenuItem) SetIconImage(img image.Image) {
+	iconBytes, err := encodeIcon(img)
+	if err != nil {
+		logger().Error("failed to set menu item icon", "item", item.id, "err", err)
+		return
+	}
+	item.SetIcon(iconBytes)
+}
+
+// IconCacheStats are the statistics of the icon cache and the suppressed updates for debugging.
+type IconCacheStats struct {
+	// Hits and Misses count the icons found and not found in the cache
+	Hits, Misses uint64
+	// Entries is the number of the cached icons
+	Entries int
+	// Suppressed counts the icon, title, tooltip and status updates skipped because nothing has changed
+	Suppressed uint64
+}
+
+// GetIconCacheStats returns the statistics of the icon cache of all trays.
+// On Linux the decoded icons are cached by their content, so setting the same icon again is cheap,
+// and the tray state updates not changing anything are neither published nor signaled.
+// The statistics are always zero on other platforms.
+func GetIconCacheStats() IconCacheStats {
+	return iconCacheStats()
+}
+
+// encodePNG encodes the image for the platforms taking the encoded icons,
+// the returned error wraps ErrBadIcon
+func encodePNG(img image.Image) ([]byte, error) {
+	if img == nil {
+		return nil, fmt.Errorf("%w: no image", ErrBadIcon)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadIcon, err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,387 @@
+//go:build (linux || freebsd || openbsd || netbsd) && !android
+
+package systray
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// icoHeader starts every ICO file: reserved 0 and type 1
+const icoHeader = "\x00\x00\x01\x00"
+
+func init() {
+	image.RegisterFormat("bmp", "BM", decodeBMP, decodeBMPConfig)
+	image.RegisterFormat("ico", icoHeader, decodeICO, decodeICOConfig)
+}
+
+// iconCacheSize is the number of the decoded icons kept by iconCache
+const iconCacheSize = 16
+
+// icons keeps the recently decoded icons of all trays
+var icons = newIconCache(iconCacheSize)
+
+// suppressedUpdates counts the tray state changes skipped because nothing has changed
+var suppressedUpdates atomic.Uint64
+
+// iconCache keeps the least recently used icons decoded by convertToPixels by their content hash.
+// The cached pixmaps are shared, so they must never be modified.
+type iconCache struct {
+	lock         sync.Mutex
+	size         int
+	entries      map[[sha256.Size]byte]*list.Element
+	order        *list.List // of *iconCacheEntry, the most recently used first
+	hits, misses uint64
+}
+
+type iconCacheEntry struct {
+	key     [sha256.Size]byte
+	pixmaps []PX
+}
+
+func newIconCache(size int) *iconCache {
+	return &iconCache{
+		size:    size,
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// decode returns the pixmaps of the icon decoding it only when it isn't cached
+func (c *iconCache) decode(data []byte) ([]PX, error) {
+	key := sha256.Sum256(data)
+	c.lock.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.hits++
+		c.order.MoveToFront(e)
+		c.lock.Unlock()
+		return e.Value.(*iconCacheEntry).pixmaps, nil
+	}
+	c.misses++
+	c.lock.Unlock()
+
+	// the lock isn't held while decoding, so the same icon can be decoded twice by the concurrent calls
+	pixmaps, err := convertToPixels(data)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		c.entries[key] = c.order.PushFront(&iconCacheEntry{key: key, pixmaps: pixmaps})
+		if c.order.Len() > c.size {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*iconCacheEntry).key)
+		}
+	}
+	return pixmaps, nil
+}
+
+func iconCacheStats() IconCacheStats {
+	icons.lock.Lock()
+	defer icons.lock.Unlock()
+	return IconCacheStats{
+		Hits:       icons.hits,
+		Misses:     icons.misses,
+		Entries:    icons.order.Len(),
+		Suppressed: suppressedUpdates.Load(),
+	}
+}
+
+// equalPixmaps checks if the pixmaps are the same, the pixels shared by the cached pixmaps aren't compared
+func equalPixmaps(a, b []PX) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].W != b[i].W || a[i].H != b[i].H || len(a[i].Pix) != len(b[i].Pix) {
+			return false
+		}
+		if len(a[i].Pix) > 0 && &a[i].Pix[0] == &b[i].Pix[0] {
+			continue
+		}
+		if !bytes.Equal(a[i].Pix, b[i].Pix) {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeICO decodes the largest image of the ICO file
+func decodeICO(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	frames, err := decodeICOFrames(data)
+	if err != nil {
+		return nil, err
+	}
+	largest := frames[0]
+	for _, frame := range frames[1:] {
+		if frame.Bounds().Dx()*frame.Bounds().Dy() > largest.Bounds().Dx()*largest.Bounds().Dy() {
+			largest = frame
+		}
+	}
+	return largest, nil
+}
+
+func decodeICOConfig(r io.Reader) (image.Config, error) {
+	img, err := decodeICO(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: img.ColorModel(), Width: img.Bounds().Dx(), Height: img.Bounds().Dy()}, nil
+}
+
+// decodeICOFrames decodes all images of the ICO file in the file order.
+// The images are either PNG or DIB with the AND mask.
+func decodeICOFrames(data []byte) ([]image.Image, error) {
+	if len(data) < 6 || string(data[:4]) != icoHeader {
+		return nil, errors.New("ico: not an icon file")
+	}
+	count := int(binary.LittleEndian.Uint16(data[4:]))
+	if count == 0 {
+		return nil, errors.New("ico: no images")
+	}
+	if len(data) < 6+16*count {
+		return nil, errors.New("ico: truncated directory")
+	}
+	frames := make([]image.Image, 0, count)
+	for i := range count {
+		entry := data[6+16*i:]
+		size := int64(binary.LittleEndian.Uint32(entry[8:]))
+		offset := int64(binary.LittleEndian.Uint32(entry[12:]))
+		if offset+size > int64(len(data)) {
+			return nil, fmt.Errorf("ico: image %d is out of the file", i)
+		}
+		frame := data[offset : offset+size]
+		var img image.Image
+		var err error
+		if bytes.HasPrefix(frame, []byte(pngSignature)) {
+			img, err = png.Decode(bytes.NewReader(frame))
+		} else {
+			img, err = decodeDIB(frame, true)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ico: image %d: %w", i, err)
+		}
+		frames = append(frames, img)
+	}
+	return frames, nil
+}
+
+// decodeBMP decodes the BMP file, it's the DIB with the 14 bytes file header
+func decodeBMP(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 14 || string(data[:2]) != "BM" {
+		return nil, errors.New("bmp: not a BMP file")
+	}
+	img, err := decodeDIB(data[14:], false)
+	if err != nil {
+		return nil, fmt.Errorf("bmp: %w", err)
+	}
+	return img, nil
+}
+
+func decodeBMPConfig(r io.Reader) (image.Config, error) {
+	img, err := decodeBMP(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: img.ColorModel(), Width: img.Bounds().Dx(), Height: img.Bounds().Dy()}, nil
+}
+
+// DIB compression methods
+const (
+	biRGB       = 0
+	biBitFields = 3
+)
+
+// decodeDIB decodes the uncompressed device independent bitmap starting with BITMAPINFOHEADER
+// or its later versions. The icon DIB has the doubled height and the AND mask follows the pixels.
+func decodeDIB(data []byte, icon bool) (image.Image, error) {
+	if len(data) < 40 {
+		return nil, errors.New("truncated header")
+	}
+	le := binary.LittleEndian
+	headerSize := int(le.Uint32(data))
+	width := int(int32(le.Uint32(data[4:])))
+	height := int(int32(le.Uint32(data[8:])))
+	bpp := int(le.Uint16(data[14:]))
+	compression := le.Uint32(data[16:])
+	colorsUsed := int(le.Uint32(data[32:]))
+	if headerSize < 40 || headerSize > len(data) {
+		return nil, fmt.Errorf("unsupported header size %d", headerSize)
+	}
+	topDown := height < 0
+	if topDown {
+		height = -height
+	}
+	if icon {
+		height /= 2
+	}
+	if width <= 0 || height <= 0 || width > maxIconSize || height > maxIconSize {
+		return nil, fmt.Errorf("bad size %dx%d", width, height)
+	}
+
+	pos := headerSize
+	var masks [4]uint32
+	switch {
+	case compression == biRGB && bpp == 16:
+		masks = [4]uint32{0x7c00, 0x03e0, 0x001f, 0}
+	case compression == biRGB && bpp == 32:
+		masks = [4]uint32{0xff0000, 0xff00, 0xff, 0xff000000}
+	case compression == biBitFields && (bpp == 16 || bpp == 32):
+		if headerSize >= 52 {
+			// BITMAPV2INFOHEADER and later keep the RGB masks in the header,
+			// BITMAPV3INFOHEADER and later keep the alpha mask too
+			for i := range 3 {
+				masks[i] = le.Uint32(data[40+4*i:])
+			}
+			if headerSize >= 56 {
+				masks[3] = le.Uint32(data[52:])
+			}
+		} else {
+			if len(data) < pos+12 {
+				return nil, errors.New("truncated bit fields")
+			}
+			for i := range 3 {
+				masks[i] = le.Uint32(data[pos+4*i:])
+			}
+			pos += 12
+		}
+	case compression != biRGB:
+		return nil, fmt.Errorf("unsupported compression %d", compression)
+	}
+
+	var palette []color.NRGBA
+	switch bpp {
+	case 1, 4, 8:
+		if colorsUsed == 0 || colorsUsed > 1<<bpp {
+			colorsUsed = 1 << bpp
+		}
+		if len(data) < pos+4*colorsUsed {
+			return nil, errors.New("truncated palette")
+		}
+		palette = make([]color.NRGBA, colorsUsed)
+		for i := range palette {
+			c := data[pos+4*i:]
+			palette[i] = color.NRGBA{R: c[2], G: c[1], B: c[0], A: 0xff}
+		}
+		pos += 4 * colorsUsed
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("unsupported bit count %d", bpp)
+	}
+
+	stride := (width*bpp + 31) / 32 * 4
+	if len(data) < pos+stride*height {
+		return nil, errors.New("truncated pixels")
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	hasAlpha := false
+	for row := range height {
+		y := height - 1 - row
+		if topDown {
+			y = row
+		}
+		line := data[pos+row*stride:]
+		for x := range width {
+			var c color.NRGBA
+			switch bpp {
+			case 1, 4, 8:
+				bit := x * bpp
+				index := int(line[bit/8]>>(8-bpp-bit%8)) & (1<<bpp - 1)
+				if index >= len(palette) {
+					return nil, fmt.Errorf("color index %d is out of the palette", index)
+				}
+				c = palette[index]
+			case 24:
+				c = color.NRGBA{R: line[3*x+2], G: line[3*x+1], B: line[3*x], A: 0xff}
+			case 16:
+				c = maskedColor(uint32(le.Uint16(line[2*x:])), masks)
+			case 32:
+				c = maskedColor(le.Uint32(line[4*x:]), masks)
+			}
+			hasAlpha = hasAlpha || c.A != 0
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	pos += stride * height
+
+	if bpp == 32 && masks[3] != 0 && !hasAlpha {
+		// the alpha channel is unused, so the image is opaque or transparent by the AND mask
+		for i := 3; i < len(img.Pix); i += 4 {
+			img.Pix[i] = 0xff
+		}
+	}
+	if icon && (bpp < 32 || !hasAlpha) {
+		applyANDMask(img, data[pos:], topDown)
+	}
+	return img, nil
+}
+
+// maskedColor extracts the color from the pixel value by the RGBA bit masks,
+// the color is opaque when there is no alpha mask
+func maskedColor(v uint32, masks [4]uint32) color.NRGBA {
+	c := color.NRGBA{
+		R: maskedChannel(v, masks[0]),
+		G: maskedChannel(v, masks[1]),
+		B: maskedChannel(v, masks[2]),
+		A: 0xff,
+	}
+	if masks[3] != 0 {
+		c.A = maskedChannel(v, masks[3])
+	}
+	return c
+}
+
+// maskedChannel scales the masked value to 8 bits
+func maskedChannel(v, mask uint32) byte {
+	if mask == 0 {
+		return 0
+	}
+	shift := bits.TrailingZeros32(mask)
+	width := bits.OnesCount32(mask)
+	value := (v & mask) >> shift
+	full := uint32(1)<<width - 1
+	return byte(uint64(value) * 0xff / uint64(full))
+}
+
+// applyANDMask makes the pixels transparent where the 1 bpp AND mask is set,
+// the missing mask leaves the image as it is
+func applyANDMask(img *image.NRGBA, mask []byte, topDown bool) {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	stride := (width + 31) / 32 * 4
+	if len(mask) < stride*height {
+		return
+	}
+	for row := range height {
+		y := height - 1 - row
+		if topDown {
+			y = row
+		}
+		line := mask[row*stride:]
+		for x := range width {
+			if line[x/8]&(0x80>>(x%8)) != 0 {
+				img.Pix[img.PixOffset(x, y)+3] = 0
+			}
+		}
+	}
+}
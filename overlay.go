@@ -0,0 +1,156 @@
+package systray
+
+import (
+	"image/color"
+	"math"
+)
+
+// badgeLimit is the largest count shown by the badge, the larger counts are shown as "99+"
+const badgeLimit = 99
+
+// BadgeStyle is the look of the badge drawn by SetBadge.
+type BadgeStyle struct {
+	// Background is the color of the badge circle, red when it's nil
+	Background color.Color
+	// Foreground is the color of the count, white when it's nil
+	Foreground color.Color
+}
+
+// defaultBadgeStyle is the BadgeStyle with the default colors
+var defaultBadgeStyle = BadgeStyle{
+	Background: color.NRGBA{R: 0xe5, G: 0x39, B: 0x35, A: 0xff},
+	Foreground: color.White,
+}
+
+// withDefaults replaces the missing colors by the default ones
+func (s BadgeStyle) withDefaults() BadgeStyle {
+	if s.Background == nil {
+		s.Background = defaultBadgeStyle.Background
+	}
+	if s.Foreground == nil {
+		s.Foreground = defaultBadgeStyle.Foreground
+	}
+	return s
+}
+
+// SetBadge draws the count in the top right corner of the tray icon at every icon size,
+// only available on Linux, as many hosts ignore the overlay icons. The counts over 99 are
+// shown as "99+", zero or negative count removes the badge. The badge stays when the icon
+// is changed, it's removed when the tray quits.
+func SetBadge(n int) {
+	defaultTray.SetBadge(n)
+}
+
+// SetBadge draws the count on the tray icon, see the package level SetBadge.
+func (t *Tray) SetBadge(n int) {
+	if err := t.setBadge(max(n, 0)); err != nil {
+		logger().Error("failed to set badge", errorAttrs(err)...)
+	}
+}
+
+// ClearBadge removes the badge drawn by SetBadge.
+func ClearBadge() {
+	defaultTray.ClearBadge()
+}
+
+// ClearBadge removes the badge from the tray icon, see the package level ClearBadge.
+func (t *Tray) ClearBadge() {
+	t.SetBadge(0)
+}
+
+// SetBadgeStyle sets the colors of the badge, only available on Linux.
+func SetBadgeStyle(style BadgeStyle) {
+	defaultTray.SetBadgeStyle(style)
+}
+
+// SetBadgeStyle sets the colors of the badge, see the package level SetBadgeStyle.
+func (t *Tray) SetBadgeStyle(style BadgeStyle) {
+	if err := t.setBadgeStyle(style.withDefaults()); err != nil {
+		logger().Error("failed to set badge style", errorAttrs(err)...)
+	}
+}
+
+// ProgressShape is the shape of the progress indicator drawn by SetProgress
+type ProgressShape int
+
+const (
+	// ProgressRing is the ring along the icon border filled clockwise from the top
+	ProgressRing ProgressShape = iota
+	// ProgressBar is the bar at the bottom of the icon filled from the left
+	ProgressBar
+)
+
+// ProgressStyle is the look of the progress indicator drawn by SetProgress.
+type ProgressStyle struct {
+	// Shape is the shape of the indicator, the ring by default
+	Shape ProgressShape
+	// Color is the color of the done part, green when it's nil
+	Color color.Color
+	// Track is the color of the remaining part, translucent black when it's nil
+	Track color.Color
+}
+
+// defaultProgressStyle is the ProgressStyle with the default colors
+var defaultProgressStyle = ProgressStyle{
+	Shape: ProgressRing,
+	Color: color.NRGBA{R: 0x43, G: 0xa0, B: 0x47, A: 0xff},
+	Track: color.NRGBA{A: 0x80},
+}
+
+// withDefaults replaces the missing colors by the default ones
+func (s ProgressStyle) withDefaults() ProgressStyle {
+	if s.Color == nil {
+		s.Color = defaultProgressStyle.Color
+	}
+	if s.Track == nil {
+		s.Track = defaultProgressStyle.Track
+	}
+	return s
+}
+
+// SetProgress draws the progress indicator on the tray icon at every icon size, only available on Linux.
+// The fraction is from 0 to 1, it's rounded to the whole percents. The frequent updates are
+// published 5 times per second at most, the latest one is never lost. The indicator stays when
+// the icon is changed, it's removed by ClearProgress or when the tray quits.
+func SetProgress(fraction float64) {
+	defaultTray.SetProgress(fraction)
+}
+
+// SetProgress draws the progress indicator on the tray icon, see the package level SetProgress.
+func (t *Tray) SetProgress(fraction float64) {
+	if math.IsNaN(fraction) {
+		logger().Error("failed to set progress, the fraction is not a number")
+		return
+	}
+	if err := t.setProgress(min(max(fraction, 0), 1)); err != nil {
+		logger().Error("failed to set progress", errorAttrs(err)...)
+	}
+}
+
+// ClearProgress removes the progress indicator drawn by SetProgress.
+func ClearProgress() {
+	defaultTray.ClearProgress()
+}
+
+// ClearProgress removes the progress indicator from the tray icon, see the package level ClearProgress.
+func (t *Tray) ClearProgress() {
+	if err := t.clearProgress(); err != nil {
+		logger().Error("failed to clear progress", errorAttrs(err)...)
+	}
+}
+
+// SetProgressStyle sets the shape and the colors of the progress indicator, only available on Linux.
+func SetProgressStyle(style ProgressStyle) {
+	defaultTray.SetProgressStyle(style)
+}
+
+// SetProgressStyle sets the look of the progress indicator, see the package level SetProgressStyle.
+func (t *Tray) SetProgressStyle(style ProgressStyle) {
+	if style.Shape != ProgressRing && style.Shape != ProgressBar {
+		logger().Error("failed to set unknown progress shape", "shape", style.Shape)
+		return
+	}
+	if err := t.setProgressStyle(style.withDefaults()); err != nil {
+		logger().Error("failed to set progress style", errorAttrs(err)...)
+	}
+}
@@ -0,0 +1,262 @@
+//go:build (linux || freebsd || openbsd || netbsd) && !android
+
+package systray
+
+import (
+	"image/color"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	// progressInterval is the minimal interval between the published progress updates
+	progressInterval = 200 * time.Millisecond
+	// progressSteps is the number of the progress steps
+	progressSteps = 100
+)
+
+func (tr *Tray) setBadge(n int) error {
+	t := tr.native
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.badge == n {
+		suppressedUpdates.Add(1)
+		return nil
+	}
+	t.badge = n
+	return t.iconChanged()
+}
+
+func (tr *Tray) setBadgeStyle(style BadgeStyle) error {
+	t := tr.native
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.badgeStyle = style
+	if t.badge == 0 {
+		return nil
+	}
+	return t.iconChanged()
+}
+
+func (tr *Tray) setProgress(fraction float64) error {
+	t := tr.native
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	fraction = math.Round(fraction*progressSteps) / progressSteps
+	if t.showProgress && t.progress == fraction {
+		suppressedUpdates.Add(1)
+		return nil
+	}
+	t.progress, t.showProgress = fraction, true
+	if wait := progressInterval - time.Since(t.progressPublished); wait > 0 {
+		// the latest progress is published when the interval ends
+		if t.progressTimer == nil {
+			t.progressTimer = time.AfterFunc(wait, t.flushProgress)
+		}
+		return nil
+	}
+	return t.publishProgress()
+}
+
+func (tr *Tray) clearProgress() error {
+	t := tr.native
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.showProgress {
+		suppressedUpdates.Add(1)
+		return nil
+	}
+	t.showProgress = false
+	t.stopProgressTimer()
+	return t.publishProgress()
+}
+
+func (tr *Tray) setProgressStyle(style ProgressStyle) error {
+	t := tr.native
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.progressStyle = style
+	if !t.showProgress {
+		return nil
+	}
+	return t.iconChanged()
+}
+
+// publishProgress publishes the icon with the current progress, it is always called after t.lock.Lock().
+func (t *tray) publishProgress() error {
+	t.progressPublished = time.Now()
+	return t.iconChanged()
+}
+
+// flushProgress publishes the progress deferred by setProgress
+func (t *tray) flushProgress() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.progressTimer = nil
+	if err := t.publishProgress(); err != nil {
+		logger().Warn("failed to publish progress", "err", err)
+	}
+}
+
+// stopProgressTimer drops the deferred progress, it is always called after t.lock.Lock().
+func (t *tray) stopProgressTimer() {
+	if t.progressTimer != nil {
+		t.progressTimer.Stop()
+		t.progressTimer = nil
+	}
+}
+
+// decoratedIcon returns the copy of the icon pixmaps with the progress and the badge drawn on them,
+// it is always called after t.lock.Lock().
+func (t *tray) decoratedIcon() []PX {
+	if t.badge == 0 && !t.showProgress {
+		return published(t.iconData)
+	}
+	badgeStyle, progressStyle := t.badgeStyle.withDefaults(), t.progressStyle.withDefaults()
+	text := strconv.Itoa(t.badge)
+	if t.badge > badgeLimit {
+		text = strconv.Itoa(badgeLimit) + "+"
+	}
+	// the pixels are copied before drawing, as the icon pixmaps can be shared by the icon cache
+	pixmaps := make([]PX, len(t.iconData))
+	for i, p := range t.iconData {
+		p.Pix = append([]byte(nil), p.Pix...)
+		if p.W > 0 && p.H > 0 && len(p.Pix) == p.W*p.H*4 {
+			if t.showProgress {
+				drawProgress(p, t.progress, progressStyle)
+			}
+			if t.badge > 0 {
+				drawBadge(p, text, badgeStyle)
+			}
+		}
+		pixmaps[i] = p
+	}
+	return pixmaps
+}
+
+// drawProgress draws the progress indicator of the fraction on the pixmap
+func drawProgress(p PX, fraction float64, style ProgressStyle) {
+	done := color.NRGBAModel.Convert(style.Color).(color.NRGBA)
+	track := color.NRGBAModel.Convert(style.Track).(color.NRGBA)
+	size := min(p.W, p.H)
+	if style.Shape == ProgressBar {
+		height := max(size/6, 2)
+		// the column partially covered by the done part is blended from both colors
+		edge := fraction * float64(p.W)
+		for y := p.H - height; y < p.H; y++ {
+			for x := range p.W {
+				part := math.Min(math.Max(edge-float64(x), 0), 1)
+				blend(p, x, y, track, 1-part)
+				blend(p, x, y, done, part)
+			}
+		}
+		return
+	}
+
+	outer := float64(size) / 2
+	inner := outer - math.Max(float64(size)/8, 2)
+	cx, cy := float64(p.W)/2, float64(p.H)/2
+	for y := range p.H {
+		for x := range p.W {
+			dx, dy := float64(x)+0.5-cx, float64(y)+0.5-cy
+			d := math.Hypot(dx, dy)
+			coverage := math.Min(outer-d, d-inner) + 0.5
+			if coverage <= 0 {
+				continue
+			}
+			// the angle is measured clockwise from the top
+			angle := math.Atan2(dx, -dy)
+			if angle < 0 {
+				angle += 2 * math.Pi
+			}
+			if angle < fraction*2*math.Pi {
+				blend(p, x, y, done, coverage)
+			} else {
+				blend(p, x, y, track, coverage)
+			}
+		}
+	}
+}
+
+// glyphs are the 3x5 bitmaps of the badge characters, a row per byte with the leftmost pixel in bit 2
+var glyphs = map[rune][5]byte{
+	'0': {7, 5, 5, 5, 7},
+	'1': {2, 6, 2, 2, 7},
+	'2': {7, 1, 7, 4, 7},
+	'3': {7, 1, 7, 1, 7},
+	'4': {5, 5, 7, 1, 1},
+	'5': {7, 4, 7, 1, 7},
+	'6': {7, 4, 7, 5, 7},
+	'7': {7, 1, 1, 1, 1},
+	'8': {7, 5, 7, 5, 7},
+	'9': {7, 5, 7, 1, 7},
+	'+': {0, 2, 7, 2, 0},
+}
+
+// drawBadge draws the text on the pill in the top right corner of the pixmap,
+// the pill is the circle for the single character
+func drawBadge(p PX, text string, style BadgeStyle) {
+	// the glyphs are scaled by the whole pixels to stay sharp, the scale is reduced
+	// when the pill is wider than the pixmap
+	scale := max(int(math.Round(float64(min(p.W, p.H))*0.5/7)), 1)
+	textWidth := func() int { return len(text)*4*scale - scale }
+	for scale > 1 && textWidth()+7*scale/2 > p.W {
+		scale--
+	}
+	height := 7 * scale
+	width := max(height, textWidth()+height/2)
+	x0 := float64(p.W - width)
+	radius := float64(height) / 2
+
+	background := color.NRGBAModel.Convert(style.Background).(color.NRGBA)
+	for y := 0; y < height && y < p.H; y++ {
+		for x := max(p.W-width, 0); x < p.W; x++ {
+			// the distance to the segment between the centers of the pill ends
+			cx := math.Min(math.Max(float64(x)+0.5, x0+radius), x0+float64(width)-radius)
+			d := math.Hypot(float64(x)+0.5-cx, float64(y)+0.5-radius)
+			blend(p, x, y, background, radius-d+0.5)
+		}
+	}
+
+	foreground := color.NRGBAModel.Convert(style.Foreground).(color.NRGBA)
+	left := p.W - width + (width-textWidth())/2
+	top := scale
+	for i, r := range text {
+		glyph := glyphs[r]
+		for row, bits := range glyph {
+			for col := range 3 {
+				if bits&(4>>col) == 0 {
+					continue
+				}
+				for dy := range scale {
+					for dx := range scale {
+						blend(p, left+(i*4+col)*scale+dx, top+row*scale+dy, foreground, 1)
+					}
+				}
+			}
+		}
+	}
+}
+
+// blend draws the color over the ARGB pixel with the coverage from 0 to 1,
+// the pixels out of the pixmap are skipped
+func blend(p PX, x, y int, c color.NRGBA, coverage float64) {
+	if x < 0 || y < 0 || x >= p.W || y >= p.H || coverage <= 0 {
+		return
+	}
+	i := (y*p.W + x) * 4
+	srcA := float64(c.A) / 0xff * math.Min(coverage, 1)
+	dstA := float64(p.Pix[i]) / 0xff
+	outA := srcA + dstA*(1-srcA)
+	if outA == 0 {
+		return
+	}
+	channel := func(src byte, dst byte) byte {
+		return byte(math.Round((float64(src)*srcA + float64(dst)*dstA*(1-srcA)) / outA))
+	}
+	p.Pix[i+1] = channel(c.R, p.Pix[i+1])
+	p.Pix[i+2] = channel(c.G, p.Pix[i+2])
+	p.Pix[i+3] = channel(c.B, p.Pix[i+3])
+	p.Pix[i] = byte(math.Round(outA * 0xff))
+}
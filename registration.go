@@ -0,0 +1,147 @@
+package systray
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// RegistrationState is the state of the tray registration in the host
+type RegistrationState int
+
+const (
+	// StateUnregistered means that the tray is not running or it's not registered yet
+	StateUnregistered RegistrationState = iota
+	// StateRegistered means that the tray is registered and shown by the host
+	StateRegistered
+	// StateNoWatcher means that there is no StatusNotifierWatcher on the session bus, so the tray
+	// can't be registered until it appears (Linux)
+	StateNoWatcher
+	// StateNoHost means that the tray is registered, but the watcher reports that there is no
+	// StatusNotifierHost to show it, usually because the desktop has no tray (Linux)
+	StateNoHost
+)
+
+func (s RegistrationState) String() string {
+	switch s {
+	case StateUnregistered:
+		return "Unregistered"
+	case StateRegistered:
+		return "Registered"
+	case StateNoWatcher:
+		return "NoWatcher"
+	case StateNoHost:
+		return "NoHost"
+	}
+	return fmt.Sprintf("RegistrationState(%d)", int(s))
+}
+
+// Registered checks if the tray is registered in the host.
+// On Linux the registration is verified periodically and restored when the watcher loses it.
+// On Windows and macOS the tray is registered while it's running.
+func Registered() bool {
+	return defaultTray.Registered()
+}
+
+// Registered checks if the tray is registered in the host, see the package level Registered.
+func (t *Tray) Registered() bool {
+	return t.Registration() == StateRegistered
+}
+
+// Registration returns the current registration state of the tray.
+func Registration() RegistrationState {
+	return defaultTray.Registration()
+}
+
+// Registration returns the current registration state of the tray, see the package level Registration.
+func (t *Tray) Registration() RegistrationState {
+	return t.registration.get()
+}
+
+// RegistrationChanges returns a channel delivering the registration state of the tray: the current
+// state first and then every change of it. A slow reader misses the intermediate states,
+// but it always gets the latest one. The channel is closed when ctx is cancelled.
+func RegistrationChanges(ctx context.Context) <-chan RegistrationState {
+	return defaultTray.RegistrationChanges(ctx)
+}
+
+// RegistrationChanges returns a channel delivering the registration state of the tray,
+// see the package level RegistrationChanges.
+func (t *Tray) RegistrationChanges(ctx context.Context) <-chan RegistrationState {
+	ch := t.registration.watch()
+	go func() {
+		<-ctx.Done()
+		t.registration.unwatch(ch)
+	}()
+	return ch
+}
+
+// registration keeps the registration state of the tray and notifies the watchers of its changes
+type registration struct {
+	lock     sync.Mutex
+	state    RegistrationState
+	watchers map[chan RegistrationState]struct{}
+	// events gets EventRegistered or EventUnregistered on every state change
+	events *eventHub
+}
+
+func (r *registration) get() RegistrationState {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.state
+}
+
+// set changes the state and notifies the watchers, it never blocks
+func (r *registration) set(state RegistrationState) {
+	r.change(state, nil)
+}
+
+// change changes the state like set does, err is the reason of the change reported by EventUnregistered
+func (r *registration) change(state RegistrationState, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.state == state {
+		return
+	}
+	r.state = state
+	for ch := range r.watchers {
+		notify(ch, state)
+	}
+	if r.events == nil {
+		return
+	}
+	// the event is published under the lock, so the events come in the order of the changes
+	e := Event{Type: EventUnregistered, State: state, Err: err}
+	if state == StateRegistered || state == StateNoHost {
+		e.Type, e.Err = EventRegistered, nil
+	}
+	r.events.publish(e)
+}
+
+// notify replaces the unread state in ch by the new one, it's always called after registration.lock.Lock()
+func notify(ch chan RegistrationState, state RegistrationState) {
+	select {
+	case <-ch:
+	default:
+	}
+	ch <- state
+}
+
+func (r *registration) watch() chan RegistrationState {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.watchers == nil {
+		r.watchers = make(map[chan RegistrationState]struct{})
+	}
+	ch := make(chan RegistrationState, 1)
+	ch <- r.state
+	r.watchers[ch] = struct{}{}
+	return ch
+}
+
+func (r *registration) unwatch(ch chan RegistrationState) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.watchers, ch)
+	close(ch)
+}
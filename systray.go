@@ -2,44 +2,299 @@
 package systray
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"iter"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
 	"runtime"
 	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 var (
-	systrayReady      func()
-	systrayExit       func()
-	systrayExitCalled atomic.Bool
-	menuItems         = make(map[uint32]*MenuItem)
-	menuItemsLock     sync.RWMutex
-
 	currentID atomic.Uint32
-	quitOnce  sync.Once
+
+	// menu refresh latency bounds in nanoseconds, see SetRefreshLatency
+	refreshMinLatency atomic.Int64
+	refreshMaxLatency atomic.Int64
+
+	// reconnection delay bounds in nanoseconds, see SetReconnectDelay
+	reconnectMinDelay atomic.Int64
+	reconnectMaxDelay atomic.Int64
 )
 
-// This helper function allows us to call systrayExit only once,
+var (
+	// ErrNoSessionBus is returned when the D-Bus session bus is not available (Linux)
+	ErrNoSessionBus = errors.New("no D-Bus session bus")
+	// ErrNoWatcher is reported when there is no StatusNotifierWatcher to register the tray in (Linux)
+	ErrNoWatcher = errors.New("no StatusNotifierWatcher")
+	// ErrNameTaken is reported when the D-Bus name of the tray is owned by someone else (Linux)
+	ErrNameTaken = errors.New("D-Bus name is already taken")
+	// ErrBadIcon is returned when the icon can't be decoded
+	ErrBadIcon = errors.New("bad icon")
+	// ErrConnectionLost is returned when the connection to the D-Bus session bus is lost (Linux)
+	ErrConnectionLost = errors.New("D-Bus connection lost")
+)
+
+const (
+	// DefaultRefreshMinLatency is the default delay of the menu update after the last change
+	DefaultRefreshMinLatency = 5 * time.Millisecond
+	// DefaultRefreshMaxLatency is the default limit of the menu update delay after the first change
+	DefaultRefreshMaxLatency = 100 * time.Millisecond
+	// DefaultReconnectMinDelay is the default delay of the first reconnection attempt
+	DefaultReconnectMinDelay = 100 * time.Millisecond
+	// DefaultReconnectMaxDelay is the default limit of the delay between reconnection attempts
+	DefaultReconnectMaxDelay = 30 * time.Second
+)
+
+// Tray is a tray icon with its own menu.
+// The package level functions operate on the default tray, New creates additional ones.
+// Tray methods mirror the package level functions and behave the same way.
+type Tray struct {
+	// native is the platform specific part of the tray
+	native *tray
+
+	ready      func(ReadyInfo)
+	exit       func()
+	exitCalled atomic.Bool
+	// quitCalled is set by Quit, it's reset when the tray is ready for the next run
+	quitCalled atomic.Bool
+
+	menuItems     map[uint32]*MenuItem
+	menuItemsLock sync.RWMutex
+	// menuRoots are the top level menu items in menu order, guarded by menuItemsLock
+	menuRoots []*MenuItem
+
+	// events delivers the tray events to the Events subscribers
+	events *eventHub
+	// registration is the registration state of the tray in the host
+	registration registration
+
+	// signals make the tray quit while it runs, see WithSignalHandling,
+	// stopSignals is closed to stop their handling when the tray has quit
+	signalsLock sync.Mutex
+	signals     []os.Signal
+	stopSignals chan struct{}
+
+	// animation is the icon animation playing now, see SetIconAnimation
+	animationLock sync.Mutex
+	animation     *Animation
+}
+
+// Option configures a tray, see New and Configure
+type Option func(*Tray)
+
+// WithID sets the technical ID of the tray item like SetID does, only used on Linux.
+func WithID(id string) Option {
+	return func(t *Tray) {
+		t.SetID(id)
+	}
+}
+
+// WithBusAddress makes the tray connect to the D-Bus bus at the given address instead of
+// the session bus, only used on Linux. The tray owns the connection: it's closed when the tray
+// quits and it's reconnected when it's lost.
+func WithBusAddress(address string) Option {
+	return func(t *Tray) {
+		t.native.setBusAddress(address)
+	}
+}
+
+// WithSignalHandling makes the tray quit on the given OS signals while it runs, SIGINT and SIGTERM
+// are used when no signals are given. So onExit is called and the tray is removed from the host
+// when the application is stopped by Ctrl-C or by the service manager, see Quit.
+// The handling stops after the first signal, so the next one terminates the application as usual.
+func WithSignalHandling(signals ...os.Signal) Option {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	return func(t *Tray) {
+		t.signalsLock.Lock()
+		defer t.signalsLock.Unlock()
+		t.signals = signals
+	}
+}
+
+// defaultTray is the tray operated by the package level functions
+var defaultTray = newTray()
+
+func newTray() *Tray {
+	t := &Tray{
+		menuItems: make(map[uint32]*MenuItem),
+		events:    newEventHub(),
+	}
+	t.registration.events = t.events
+	t.native = newNativeTray(t)
+	return t
+}
+
+// Configure applies the options to the default tray, they take effect on the next Run.
+func Configure(opts ...Option) {
+	defaultTray.Configure(opts...)
+}
+
+// Configure applies the options to the tray, they take effect on the next Run.
+func (t *Tray) Configure(opts ...Option) {
+	for _, opt := range opts {
+		opt(t)
+	}
+}
+
+// New creates an additional tray icon with its own menu. The tray is set up and run by its methods
+// the same way as the default tray is by the package level functions, several trays can run concurrently.
+// On Linux every tray has its own D-Bus bus name and object paths, so the host shows them as independent icons.
+// Only the default tray is available on Windows and macOS, New returns an error wrapping
+// errors.ErrUnsupported there.
+func New(opts ...Option) (*Tray, error) {
+	if !multipleTrays {
+		return nil, fmt.Errorf("multiple trays on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+	}
+	t := newTray()
+	t.Configure(opts...)
+	return t, nil
+}
+
+// This helper function allows us to call the exit callback only once,
 // without accidentally calling it twice in the same lifetime.
-func runSystrayExit() {
-	if systrayExitCalled.CompareAndSwap(false, true) {
-		systrayExit()
+func (t *Tray) runExit() {
+	if t.exitCalled.CompareAndSwap(false, true) {
+		t.exit()
+	}
+}
+
+// customLogger is the logger set by SetLogger
+var customLogger atomic.Pointer[slog.Logger]
+
+// SetLogger sets the logger for the systray errors and debug messages.
+// By default the messages are written by slog.Default() with the "module" attribute set to "systray".
+// A nil logger silences the output entirely.
+func SetLogger(l *slog.Logger) {
+	if l == nil {
+		l = slog.New(slog.DiscardHandler)
+	}
+	customLogger.Store(l)
+}
+
+// defaultLogger is slog.Default() with the module attribute, it's rebuilt only when slog.Default() is changed
+var defaultLogger atomic.Pointer[derivedLogger]
+
+// derivedLogger is the logger derived from the base one
+type derivedLogger struct {
+	base, logger *slog.Logger
+}
+
+// callError is the error of the failed D-Bus method call or signal, only used on Linux.
+// Its method and object path are logged as the attributes, see errorAttrs.
+type callError struct {
+	method, path string
+	err          error
+}
+
+func (e *callError) Error() string {
+	return e.err.Error()
+}
+
+func (e *callError) Unwrap() error {
+	return e.err
+}
+
+// errorAttrs returns the log attributes of err with the D-Bus method and object path of the failed call
+func errorAttrs(err error) []any {
+	var callErr *callError
+	if errors.As(err, &callErr) {
+		return []any{"method", callErr.method, "path", callErr.path, "err", err}
 	}
+	return []any{"err", err}
+}
+
+// logger returns the current logger
+func logger() *slog.Logger {
+	if l := customLogger.Load(); l != nil {
+		return l
+	}
+	base := slog.Default()
+	if d := defaultLogger.Load(); d != nil && d.base == base {
+		return d.logger
+	}
+	d := &derivedLogger{base: base, logger: base.With("module", "systray")}
+	defaultLogger.Store(d)
+	return d.logger
 }
 
 func init() {
 	runtime.LockOSThread()
+	SetRefreshLatency(DefaultRefreshMinLatency, DefaultRefreshMaxLatency)
+	SetReconnectDelay(DefaultReconnectMinDelay, DefaultReconnectMaxDelay)
+}
+
+// SetRefreshLatency configures how the menu changes are delivered to the host, only used on Linux.
+// Changes are collected until no new change arrives for minLatency, but no longer
+// than maxLatency after the first change, and then published as one menu layout update.
+// maxLatency lower than minLatency is raised to minLatency.
+func SetRefreshLatency(minLatency, maxLatency time.Duration) {
+	refreshMinLatency.Store(int64(max(minLatency, 0)))
+	refreshMaxLatency.Store(int64(max(maxLatency, minLatency, 0)))
+}
+
+// refreshLatency returns the menu refresh latency bounds
+func refreshLatency() (minLatency, maxLatency time.Duration) {
+	return time.Duration(refreshMinLatency.Load()), time.Duration(refreshMaxLatency.Load())
+}
+
+// SetReconnectDelay configures the reconnection of the trays when the connection to the session bus is lost,
+// only used on Linux. The first attempt is made after minDelay, the delay is doubled after every failed
+// attempt up to maxDelay. The reconnected tray is exported again with its current icon, title, tooltip and menu
+// and registered in the host.
+// Zero minDelay disables the reconnection: the tray quits, and RunE and RunContext return ErrConnectionLost.
+func SetReconnectDelay(minDelay, maxDelay time.Duration) {
+	reconnectMinDelay.Store(int64(max(minDelay, 0)))
+	reconnectMaxDelay.Store(int64(max(maxDelay, minDelay, 0)))
+}
+
+// reconnectDelay returns the reconnection delay bounds
+func reconnectDelay() (minDelay, maxDelay time.Duration) {
+	return time.Duration(reconnectMinDelay.Load()), time.Duration(reconnectMaxDelay.Load())
 }
 
 // MenuItem is used to keep track each menu item of systray.
 // Don't create it directly, use the one systray.AddMenuItem() returned
 type MenuItem struct {
-	// ClickedCh is the channel which will be notified when the menu item is clicked
+	// ClickedCh is the channel which will be notified when the menu item is clicked.
+	// The click is dropped if no one is waiting for the channel, use OnClick to get every click.
 	ClickedCh chan struct{}
 
+	// onClick is the click handler set by OnClick
+	onClick atomic.Pointer[func(ClickEvent)]
+	// onCheckedChanged is the handler set by OnCheckedChanged
+	onCheckedChanged atomic.Pointer[func(bool)]
+	// autoToggle makes the menu item toggle its check mark on click
+	autoToggle atomic.Bool
+	// binding is the variable bound by Bind
+	binding atomic.Pointer[binding]
+
 	// id uniquely identify a menu item, not supposed to be modified
 	id uint32
+	// tray is the tray the menu item belongs to
+	tray *Tray
+	// state is the current snapshot of the menu item state, it's never modified
+	// but replaced by the modified copy
+	state atomic.Pointer[itemState]
+	// modifyLock orders the state changes, so their handlers are queued in the same order
+	modifyLock sync.Mutex
+	// parent item, for sub menus
+	parent *MenuItem
+	// children are the sub menu items in menu order, guarded by menuItemsLock
+	children []*MenuItem
+}
+
+// itemState is an immutable snapshot of the menu item state
+type itemState struct {
 	// title is the text shown on menu item
 	title string
 	// tooltip is the text shown when pointing to menu item
@@ -50,68 +305,338 @@ type MenuItem struct {
 	checked bool
 	// has the menu item a checkbox (Linux)
 	isCheckable bool
-	// parent item, for sub menus
-	parent *MenuItem
+	// hidden menu item is not shown in the menu
+	hidden bool
+}
+
+// ClickEvent describes a click on a menu item
+type ClickEvent struct {
+	// Item is the clicked menu item
+	Item *MenuItem
+	// Timestamp is the time of the click reported by the host, only available on Linux
+	Timestamp uint32
+	// Data is the value of the event data sent by the host with the click, only available on Linux.
+	// Most hosts send an empty string or nothing at all.
+	Data interface{}
+}
+
+// dispatcher calls the queued functions one by one in the order they were queued.
+// The functions are called on the dispatcher goroutine which is started on demand
+// and exits when the queue is empty. The queue is not limited, so nothing is ever dropped.
+type dispatcher struct {
+	lock    sync.Mutex
+	queue   []func()
+	running bool
+}
+
+// clickDispatcher delivers clicks to the OnClick handlers
+var clickDispatcher dispatcher
+
+// dispatch queues f to be called on the dispatcher goroutine
+func (d *dispatcher) dispatch(f func()) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.queue = append(d.queue, f)
+	if !d.running {
+		d.running = true
+		go d.loop()
+	}
+}
+
+func (d *dispatcher) loop() {
+	for {
+		d.lock.Lock()
+		if len(d.queue) == 0 {
+			d.running = false
+			d.lock.Unlock()
+			return
+		}
+		f := d.queue[0]
+		d.queue[0] = nil
+		d.queue = d.queue[1:]
+		d.lock.Unlock()
+		f()
+	}
 }
 
 func (item *MenuItem) String() string {
 	if item.parent == nil {
-		return fmt.Sprintf("MenuItem[%d, %q]", item.id, item.title)
+		return fmt.Sprintf("MenuItem[%d, %q]", item.id, item.Title())
 	}
-	return fmt.Sprintf("MenuItem[%d, parent %d, %q]", item.id, item.parent.id, item.title)
+	return fmt.Sprintf("MenuItem[%d, parent %d, %q]", item.id, item.parent.id, item.Title())
 }
 
-// newMenuItem returns a populated MenuItem object
-func newMenuItem(title string, tooltip string, parent *MenuItem) *MenuItem {
-	return &MenuItem{
-		ClickedCh:   make(chan struct{}),
-		id:          currentID.Add(1),
+// newMenuItem returns a populated MenuItem object registered in the menu tree
+func (t *Tray) newMenuItem(title string, tooltip string, isCheckable, checked bool, parent *MenuItem) *MenuItem {
+	item := &MenuItem{
+		ClickedCh: make(chan struct{}),
+		id:        currentID.Add(1),
+		tray:      t,
+		parent:    parent,
+	}
+	item.state.Store(&itemState{
 		title:       title,
 		tooltip:     tooltip,
 		disabled:    false,
-		checked:     false,
-		isCheckable: false,
-		parent:      parent,
+		checked:     checked,
+		isCheckable: isCheckable,
+		hidden:      false,
+	})
+	t.menuItemsLock.Lock()
+	defer t.menuItemsLock.Unlock()
+	t.menuItems[item.id] = item
+	if parent == nil {
+		t.menuRoots = append(t.menuRoots, item)
+	} else {
+		parent.children = append(parent.children, item)
+	}
+	return item
+}
+
+// unregister removes the menu item and all its descendants from the menu tree.
+// It must be called with the tray menuItemsLock held.
+func (item *MenuItem) unregister() {
+	for _, child := range item.children {
+		child.unregister()
+	}
+	delete(item.tray.menuItems, item.id)
+	siblings := &item.tray.menuRoots
+	if item.parent != nil {
+		siblings = &item.parent.children
+	}
+	for i, sibling := range *siblings {
+		if sibling == item {
+			*siblings = append((*siblings)[:i:i], (*siblings)[i+1:]...)
+			break
+		}
+	}
+}
+
+// registered checks if the menu item is still a part of the menu tree
+func (item *MenuItem) registered() bool {
+	item.tray.menuItemsLock.RLock()
+	defer item.tray.menuItemsLock.RUnlock()
+	return item.tray.menuItems[item.id] == item
+}
+
+// Items returns an iterator over all menu items (excluding separators) in menu order.
+// Sub menu items are yielded right after their parent.
+// The iterator works on a snapshot of the menu tree taken when the iteration starts,
+// so it's safe to modify the menu from the loop body.
+func Items() iter.Seq[*MenuItem] {
+	return defaultTray.Items()
+}
+
+// Items returns an iterator over all menu items of the tray, see the package level Items.
+func (t *Tray) Items() iter.Seq[*MenuItem] {
+	return func(yield func(*MenuItem) bool) {
+		t.menuItemsLock.RLock()
+		items := make([]*MenuItem, 0, len(t.menuItems))
+		var walk func([]*MenuItem)
+		walk = func(level []*MenuItem) {
+			for _, item := range level {
+				items = append(items, item)
+				walk(item.children)
+			}
+		}
+		walk(t.menuRoots)
+		t.menuItemsLock.RUnlock()
+		for _, item := range items {
+			if !yield(item) {
+				return
+			}
+		}
 	}
 }
 
+// FindItem returns the menu item with the given ID or nil if there is no such item in the menu.
+func FindItem(id uint32) *MenuItem {
+	return defaultTray.FindItem(id)
+}
+
+// FindItem returns the menu item of the tray with the given ID, see the package level FindItem.
+func (t *Tray) FindItem(id uint32) *MenuItem {
+	t.menuItemsLock.RLock()
+	defer t.menuItemsLock.RUnlock()
+	return t.menuItems[id]
+}
+
+// ReadyInfo describes the tray when onReady is called.
+type ReadyInfo struct {
+	// BusName is the D-Bus name owned by the tray, it's empty when the name is taken
+	// and on other platforms (Linux)
+	BusName string
+	// Registered reports if the tray is registered in the StatusNotifierWatcher (Linux),
+	// it's always true on other platforms
+	Registered bool
+	// HostPresent reports if there is a host to show the tray, it's false when the watcher
+	// reports no StatusNotifierHost or there is no watcher at all (Linux)
+	HostPresent bool
+	// Err is the problem the tray has been started with, it wraps ErrNoWatcher or ErrNameTaken.
+	// The tray keeps running anyway and gets registered when the watcher appears (Linux).
+	Err error
+}
+
 // Run initializes GUI and starts the event loop, then invokes the onReady
 // callback. It blocks until systray.Quit() is called.
+// On Linux onReady is called after the tray is exported to D-Bus and its registration
+// has been attempted, so the registration state is known by then. The icon, title, tooltip
+// and menu set before that are kept and published when the tray is exported.
+// Run can be called again after it returns: the systray starts from scratch, so
+// the icon, title, tooltip and menu have to be set up again, usually by onReady.
+// Quit terminates the application on macOS, so it can't be restarted there.
 func Run(onReady, onExit func()) {
+	defaultTray.Run(onReady, onExit)
+}
+
+// Run runs the tray until it quits, see the package level Run.
+func (t *Tray) Run(onReady, onExit func()) {
+	setInternalLoop(true)
+	t.Register(onReady, onExit)
+
+	t.nativeLoop()
+	t.resetLifecycle()
+}
+
+// RunE is like Run, but it returns the error if the tray can't be created.
+// The returned error wraps ErrNoSessionBus when it's caused by the missing session bus (Linux).
+// On Linux the tray keeps running when it can't be registered in the host or its bus name
+// is taken: the problem is logged and the tray gets registered as soon as the watcher
+// appears. Use Registered and RegistrationChanges or RunWithReadyInfo to fall back to
+// another UI meanwhile. onExit is called in any case.
+func RunE(onReady, onExit func()) error {
+	return defaultTray.RunE(onReady, onExit)
+}
+
+// RunE runs the tray until it quits and returns the error, see the package level RunE.
+func (t *Tray) RunE(onReady, onExit func()) error {
+	return t.runE(readyFunc(onReady), onExit)
+}
+
+// RunWithReadyInfo is like RunE, but onReady gets the ReadyInfo describing the started tray.
+// onReady isn't called when the tray can't be created.
+func RunWithReadyInfo(onReady func(ReadyInfo), onExit func()) error {
+	return defaultTray.RunWithReadyInfo(onReady, onExit)
+}
+
+// RunWithReadyInfo runs the tray until it quits and returns the error, see the package level RunWithReadyInfo.
+func (t *Tray) RunWithReadyInfo(onReady func(ReadyInfo), onExit func()) error {
+	return t.runE(onReady, onExit)
+}
+
+func (t *Tray) runE(onReady func(ReadyInfo), onExit func()) error {
 	setInternalLoop(true)
-	Register(onReady, onExit)
+	defer t.resetLifecycle()
+	if err := t.registerE(onReady, onExit); err != nil {
+		t.runExit()
+		return err
+	}
+
+	return t.nativeLoopE()
+}
 
-	nativeLoop()
+// RunContext initializes GUI, starts the event loop and invokes the onReady callback like Run does.
+// It blocks until ctx is cancelled, Quit is called, or the connection to the host is lost
+// while the reconnection is disabled (Linux, see SetReconnectDelay).
+// The cleanup is always done before RunContext returns.
+// It returns ctx.Err() when ctx is cancelled, ErrConnectionLost when the connection is lost,
+// nil when Quit is called and the startup error like RunE does.
+func RunContext(ctx context.Context, onReady func()) error {
+	return defaultTray.RunContext(ctx, onReady)
+}
+
+// RunContext runs the tray until ctx is cancelled or the tray quits, see the package level RunContext.
+func (t *Tray) RunContext(ctx context.Context, onReady func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, t.Quit)
+	err := t.RunE(onReady, nil)
+	if !stop() && err == nil {
+		// Quit was called due to the context cancellation
+		err = ctx.Err()
+	}
+	return err
 }
 
 // RunWithExternalLoop allows the systemtray module to operate with other tookits.
 // The returned start and end functions should be called by the toolkit when the application has started and will end.
 func RunWithExternalLoop(onReady, onExit func()) (start, end func()) {
-	Register(onReady, onExit)
+	return defaultTray.RunWithExternalLoop(onReady, onExit)
+}
 
-	return nativeStart, func() {
-		nativeEnd()
-		Quit()
+// RunWithExternalLoop runs the tray with other toolkits, see the package level RunWithExternalLoop.
+func (t *Tray) RunWithExternalLoop(onReady, onExit func()) (start, end func()) {
+	t.Register(onReady, onExit)
+
+	return t.nativeStart, func() {
+		t.nativeEnd()
+		t.Quit()
+		t.resetLifecycle()
 	}
 }
 
+// RunWithExternalLoopE is like RunWithExternalLoop, but the returned start function
+// returns the error if the tray can't be created or registered in the host (see RunE).
+// On Linux the tray stays exported after the failed registration, it gets registered as soon
+// as the host appears, so it's up to the caller to call end if the error is fatal for it.
+func RunWithExternalLoopE(onReady, onExit func()) (start func() error, end func()) {
+	return defaultTray.RunWithExternalLoopE(onReady, onExit)
+}
+
+// RunWithExternalLoopE runs the tray with other toolkits, see the package level RunWithExternalLoopE.
+func (t *Tray) RunWithExternalLoopE(onReady, onExit func()) (start func() error, end func()) {
+	regErr := t.registerE(readyFunc(onReady), onExit)
+
+	return func() error {
+			if regErr != nil {
+				return regErr
+			}
+			return t.nativeStartE()
+		}, func() {
+			t.nativeEnd()
+			t.Quit()
+			t.resetLifecycle()
+		}
+}
+
 // Register initializes GUI and registers the callbacks but relies on the
 // caller to run the event loop somewhere else. It's useful if the program
 // needs to show other UI elements, for example, webview.
 // To overcome some OS weirdness, On macOS versions before Catalina, calling
 // this does exactly the same as Run().
 func Register(onReady func(), onExit func()) {
+	defaultTray.Register(onReady, onExit)
+}
+
+// Register initializes the tray but relies on the caller to run the event loop, see the package level Register.
+func (t *Tray) Register(onReady func(), onExit func()) {
+	if err := t.registerE(readyFunc(onReady), onExit); err != nil {
+		logger().Error("failed to register systray", "err", err)
+	}
+}
+
+// readyFunc adapts onReady that doesn't need the ReadyInfo
+func readyFunc(onReady func()) func(ReadyInfo) {
 	if onReady == nil {
-		systrayReady = func() {}
+		return nil
+	}
+	return func(ReadyInfo) { onReady() }
+}
+
+// registerE sets the callbacks and initializes GUI
+func (t *Tray) registerE(onReady func(ReadyInfo), onExit func()) error {
+	if onReady == nil {
+		t.ready = func(ReadyInfo) {}
 	} else {
 		// Run onReady on separate goroutine to avoid blocking event loop
-		readyCh := make(chan interface{})
+		readyCh := make(chan ReadyInfo, 1)
 		go func() {
-			<-readyCh
-			onReady()
+			onReady(<-readyCh)
 		}()
-		systrayReady = func() {
-			close(readyCh)
+		var once sync.Once
+		t.ready = func(info ReadyInfo) {
+			once.Do(func() { readyCh <- info })
 		}
 	}
 	// unlike onReady, onExit runs in the event loop to make sure it has time to
@@ -119,25 +644,229 @@ func Register(onReady func(), onExit func()) {
 	if onExit == nil {
 		onExit = func() {}
 	}
-	systrayExit = onExit
-	registerSystray()
+	t.exit = onExit
+	t.handleSignals()
+	return t.registerSystray()
+}
+
+// handleSignals makes the tray quit on the signals set by WithSignalHandling until the tray has quit
+func (t *Tray) handleSignals() {
+	t.signalsLock.Lock()
+	defer t.signalsLock.Unlock()
+	if len(t.signals) == 0 || t.stopSignals != nil {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, t.signals...)
+	stop := make(chan struct{})
+	t.stopSignals = stop
+	go func() {
+		defer signal.Stop(ch)
+		select {
+		case sig := <-ch:
+			logger().Info("quitting on signal", "signal", sig)
+			t.Quit()
+		case <-stop:
+		}
+	}()
+}
+
+// Batch calls f and applies all menu and tray changes made while f runs at once:
+// the host gets exactly one menu layout revision and one set of property change
+// signals after f returns, so it never sees a half-built menu: the host gets the menu
+// as it was before the batch till then.
+// Changes made from other goroutines while f runs are deferred as well.
+// Batch calls can be nested, the changes are applied when the outermost one returns.
+// Only Linux defers the changes, on other platforms f is just called.
+func Batch(f func()) {
+	defaultTray.Batch(f)
+}
+
+// Batch applies all changes of the tray made while f runs at once, see the package level Batch.
+func (t *Tray) Batch(f func()) {
+	t.beginBatch()
+	defer t.commitBatch()
+	f()
 }
 
 // ResetMenu will remove all menu items
 func ResetMenu() {
-	resetMenu()
+	defaultTray.ResetMenu()
+}
+
+// ResetMenu will remove all menu items of the tray
+func (t *Tray) ResetMenu() {
+	t.menuItemsLock.Lock()
+	t.menuItems = make(map[uint32]*MenuItem)
+	t.menuRoots = nil
+	t.menuItemsLock.Unlock()
+	t.resetMenu()
 }
 
-// Quit the systray
+// Quit the systray. It never blocks and it can be called any number of times from any goroutine,
+// including OS signal handlers. The event loop runs onExit and removes the tray from the host after
+// Quit: on Linux the tray is hidden, its D-Bus objects are unexported and its bus name is released,
+// so no ghost icon remains even if the connection is kept open (see WithConn).
 func Quit() {
-	quitOnce.Do(quit)
+	defaultTray.Quit()
+}
+
+// Quit the tray, see the package level Quit.
+func (t *Tray) Quit() {
+	if t.quitCalled.CompareAndSwap(false, true) {
+		t.events.publish(Event{Type: EventQuit})
+		t.quit()
+	}
+}
+
+// resetLifecycle prepares the tray for the next run, it's called when the tray has quit.
+// The menu items of the finished run are removed, but the events subscribers are kept.
+func (t *Tray) resetLifecycle() {
+	t.signalsLock.Lock()
+	if t.stopSignals != nil {
+		close(t.stopSignals)
+		t.stopSignals = nil
+	}
+	t.signalsLock.Unlock()
+	t.stopAnimation()
+	t.ResetMenu()
+	t.nativeReset()
+	t.registration.set(StateUnregistered)
+	t.exitCalled.Store(false)
+	t.quitCalled.Store(false)
+}
+
+// SetIcon sets the systray icon.
+// iconBytes should be the content of .ico for windows and .ico/.jpg/.png
+// for other platforms, Linux also accepts .gif and .bmp. On Linux every image
+// of .ico is published, so the host picks the size that fits best.
+// The animation set by SetIconAnimation or SetAnimatedIcon is stopped.
+func SetIcon(iconBytes []byte) {
+	defaultTray.SetIcon(iconBytes)
+}
+
+// SetIcon sets the tray icon, see the package level SetIcon.
+func (t *Tray) SetIcon(iconBytes []byte) {
+	if err := t.SetIconE(iconBytes); err != nil {
+		logger().Error("failed to set icon", errorAttrs(err)...)
+	}
+}
+
+// SetIconE sets the systray icon like SetIcon does, but returns the error instead of logging it.
+// The error wraps ErrBadIcon when the icon can't be decoded.
+func SetIconE(iconBytes []byte) error {
+	return defaultTray.SetIconE(iconBytes)
+}
+
+// SetIconE sets the tray icon, see the package level SetIconE.
+func (t *Tray) SetIconE(iconBytes []byte) error {
+	t.stopAnimation()
+	return t.setIcon(iconBytes)
+}
+
+// SetTemplateIcon sets the systray icon as a template icon (on macOS), falling back
+// to a regular icon on other platforms.
+// templateIconBytes and regularIconBytes should be the content of .ico for windows and
+// .ico/.jpg/.png for other platforms.
+func SetTemplateIcon(templateIconBytes []byte, regularIconBytes []byte) {
+	defaultTray.SetTemplateIcon(templateIconBytes, regularIconBytes)
+}
+
+// SetID sets the technical ID of systray item, only available on Linux.
+// it must be called before Run otherwise ID will be "systray_<PID>"
+func SetID(id string) {
+	defaultTray.SetID(id)
+}
+
+// SetTitle sets the systray title, only available on Mac and Linux.
+func SetTitle(title string) {
+	defaultTray.SetTitle(title)
+}
+
+// SetTitle sets the tray title, see the package level SetTitle.
+func (t *Tray) SetTitle(title string) {
+	if err := t.SetTitleE(title); err != nil {
+		logger().Error("failed to set title", errorAttrs(err)...)
+	}
+}
+
+// SetTitleE sets the systray title like SetTitle does, but returns the error instead of logging it.
+func SetTitleE(title string) error {
+	return defaultTray.SetTitleE(title)
+}
+
+// SetTooltip sets the systray tooltip to display on mouse hover of the tray icon,
+// only available on Mac, Windows and Linux.
+func SetTooltip(tooltip string) {
+	defaultTray.SetTooltip(tooltip)
+}
+
+// SetTooltip sets the tray tooltip, see the package level SetTooltip.
+func (t *Tray) SetTooltip(tooltip string) {
+	if err := t.SetTooltipE(tooltip); err != nil {
+		logger().Error("failed to set tooltip", errorAttrs(err)...)
+	}
+}
+
+// SetTooltipE sets the systray tooltip like SetTooltip does, but returns the error instead of logging it.
+func SetTooltipE(tooltip string) error {
+	return defaultTray.SetTooltipE(tooltip)
+}
+
+// Status is the status of the tray item, it tells the host how to show the tray
+type Status int
+
+const (
+	// StatusActive means that the tray is shown as usual
+	StatusActive Status = iota
+	// StatusPassive means that the tray isn't important now, so the host can hide it
+	StatusPassive
+	// StatusNeedsAttention means that the tray needs attention, the host shows the attention icon
+	// set by SetAttentionIconImage and draws the user's attention to the tray
+	StatusNeedsAttention
+)
+
+// String returns the status name as StatusNotifierItem defines it
+func (s Status) String() string {
+	switch s {
+	case StatusActive:
+		return "Active"
+	case StatusPassive:
+		return "Passive"
+	case StatusNeedsAttention:
+		return "NeedsAttention"
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
+// SetStatus sets the status of the tray, only available on Linux.
+// The status is reset to StatusActive when the tray quits.
+func SetStatus(status Status) {
+	defaultTray.SetStatus(status)
+}
+
+// SetStatus sets the status of the tray, see the package level SetStatus.
+func (t *Tray) SetStatus(status Status) {
+	if status < StatusActive || status > StatusNeedsAttention {
+		logger().Error("failed to set unknown status", "status", status)
+		return
+	}
+	if err := t.setStatus(status); err != nil {
+		logger().Error("failed to set status", errorAttrs(err)...)
+	}
+	t.statusChanged()
 }
 
 // AddMenuItem adds a menu item with the designated title and tooltip.
 // It can be safely invoked from different goroutines.
 // Created menu items are checkable on Windows and OSX by default. For Linux you have to use AddMenuItemCheckbox
 func AddMenuItem(title string, tooltip string) *MenuItem {
-	item := newMenuItem(title, tooltip, nil)
+	return defaultTray.AddMenuItem(title, tooltip)
+}
+
+// AddMenuItem adds a menu item to the tray menu, see the package level AddMenuItem.
+func (t *Tray) AddMenuItem(title string, tooltip string) *MenuItem {
+	item := t.newMenuItem(title, tooltip, false, false, nil)
 	item.update()
 	return item
 }
@@ -146,28 +875,36 @@ func AddMenuItem(title string, tooltip string) *MenuItem {
 // On other platforms there will be a check indicated next to the item if `checked` is true.
 // It can be safely invoked from different goroutines.
 func AddMenuItemCheckbox(title string, tooltip string, checked bool) *MenuItem {
-	item := newMenuItem(title, tooltip, nil)
-	item.isCheckable = true
-	item.checked = checked
+	return defaultTray.AddMenuItemCheckbox(title, tooltip, checked)
+}
+
+// AddMenuItemCheckbox adds a menu item with a checkbox to the tray menu, see the package level AddMenuItemCheckbox.
+func (t *Tray) AddMenuItemCheckbox(title string, tooltip string, checked bool) *MenuItem {
+	item := t.newMenuItem(title, tooltip, true, checked, nil)
 	item.update()
 	return item
 }
 
 // AddSeparator adds a separator bar to the menu
 func AddSeparator() {
-	addSeparator(currentID.Add(1), 0)
+	defaultTray.AddSeparator()
+}
+
+// AddSeparator adds a separator bar to the tray menu
+func (t *Tray) AddSeparator() {
+	t.addSeparator(currentID.Add(1), 0)
 }
 
 // AddSeparator adds a separator bar to the submenu
 func (item *MenuItem) AddSeparator() {
-	addSeparator(currentID.Add(1), item.id)
+	item.tray.addSeparator(currentID.Add(1), item.id)
 }
 
 // AddSubMenuItem adds a nested sub-menu item with the designated title and tooltip.
 // It can be safely invoked from different goroutines.
 // Created menu items are checkable on Windows and OSX by default. For Linux you have to use AddSubMenuItemCheckbox
 func (item *MenuItem) AddSubMenuItem(title string, tooltip string) *MenuItem {
-	child := newMenuItem(title, tooltip, item)
+	child := item.tray.newMenuItem(title, tooltip, false, false, item)
 	child.update()
 	return child
 }
@@ -176,93 +913,335 @@ func (item *MenuItem) AddSubMenuItem(title string, tooltip string) *MenuItem {
 // It can be safely invoked from different goroutines.
 // On Windows and OSX this is the same as calling AddSubMenuItem
 func (item *MenuItem) AddSubMenuItemCheckbox(title string, tooltip string, checked bool) *MenuItem {
-	child := newMenuItem(title, tooltip, item)
-	child.isCheckable = true
-	child.checked = checked
+	child := item.tray.newMenuItem(title, tooltip, true, checked, item)
 	child.update()
 	return child
 }
 
+// ID returns the unique identifier of the menu item
+func (item *MenuItem) ID() uint32 {
+	return item.id
+}
+
+// Title returns the text displayed on the menu item
+func (item *MenuItem) Title() string {
+	return item.state.Load().title
+}
+
+// Tooltip returns the tooltip of the menu item
+func (item *MenuItem) Tooltip() string {
+	return item.state.Load().tooltip
+}
+
+// Parent returns the parent of a sub menu item or nil for a top level menu item
+func (item *MenuItem) Parent() *MenuItem {
+	return item.parent
+}
+
+// Children returns the sub menu items in menu order
+func (item *MenuItem) Children() []*MenuItem {
+	item.tray.menuItemsLock.RLock()
+	defer item.tray.menuItemsLock.RUnlock()
+	return append([]*MenuItem(nil), item.children...)
+}
+
+// Visible checks if the menu item is shown in the menu
+func (item *MenuItem) Visible() bool {
+	return !item.state.Load().hidden
+}
+
+// modify replaces the menu item state with its copy changed by f and returns the new state.
+// The check mark change is propagated before the next modification, so the OnCheckedChanged
+// handlers are queued in the order of the changes.
+func (item *MenuItem) modify(f func(*itemState)) *itemState {
+	item.modifyLock.Lock()
+	defer item.modifyLock.Unlock()
+	old := item.state.Load()
+	state := *old
+	f(&state)
+	item.state.Store(&state)
+	if state.checked != old.checked {
+		item.checkedChanged(state.checked)
+	}
+	return &state
+}
+
+// checkedChanged propagates the new check mark state to the bound variable and the handler
+func (item *MenuItem) checkedChanged(checked bool) {
+	if b := item.binding.Load(); b != nil {
+		b.itemChanged(item)
+	}
+	if handler := item.onCheckedChanged.Load(); handler != nil {
+		clickDispatcher.dispatch(func() { (*handler)(checked) })
+	}
+}
+
 // SetTitle set the text to display on a menu item
 func (item *MenuItem) SetTitle(title string) {
-	item.title = title
+	item.modify(func(s *itemState) { s.title = title })
 	item.update()
 }
 
 // SetTooltip set the tooltip to show when mouse hover
 func (item *MenuItem) SetTooltip(tooltip string) {
-	item.tooltip = tooltip
+	item.modify(func(s *itemState) { s.tooltip = tooltip })
 	item.update()
 }
 
 // Disabled checks if the menu item is disabled
 func (item *MenuItem) Disabled() bool {
-	return item.disabled
+	return item.state.Load().disabled
 }
 
 // Enable a menu item regardless if it's previously enabled or not
 func (item *MenuItem) Enable() {
-	item.disabled = false
+	item.modify(func(s *itemState) { s.disabled = false })
 	item.update()
 }
 
 // Disable a menu item regardless if it's previously disabled or not
 func (item *MenuItem) Disable() {
-	item.disabled = true
+	item.modify(func(s *itemState) { s.disabled = true })
 	item.update()
 }
 
 // Hide hides a menu item
 func (item *MenuItem) Hide() {
-	hideMenuItem(item)
+	item.modify(func(s *itemState) { s.hidden = true })
+	if item.registered() {
+		hideMenuItem(item)
+	}
 }
 
-// Remove removes a menu item
+// Remove removes a menu item together with its sub menu items
 func (item *MenuItem) Remove() {
+	if !item.registered() {
+		return
+	}
 	removeMenuItem(item)
-	menuItemsLock.Lock()
-	delete(menuItems, item.id)
-	menuItemsLock.Unlock()
+	item.tray.menuItemsLock.Lock()
+	item.unregister()
+	item.tray.menuItemsLock.Unlock()
 }
 
 // Show shows a previously hidden menu item
 func (item *MenuItem) Show() {
-	showMenuItem(item)
+	item.modify(func(s *itemState) { s.hidden = false })
+	if item.registered() {
+		showMenuItem(item)
+	}
 }
 
 // Checked returns if the menu item has a check mark
 func (item *MenuItem) Checked() bool {
-	return item.checked
+	return item.state.Load().checked
 }
 
 // Check a menu item regardless if it's previously checked or not
 func (item *MenuItem) Check() {
-	item.checked = true
+	item.modify(func(s *itemState) { s.checked = true })
 	item.update()
 }
 
 // Uncheck a menu item regardless if it's previously unchecked or not
 func (item *MenuItem) Uncheck() {
-	item.checked = false
+	item.modify(func(s *itemState) { s.checked = false })
+	item.update()
+}
+
+// Toggle atomically inverts the check mark of a menu item and returns the new state.
+// Concurrent toggles never get lost, so it's safe to toggle the item from a click handler
+// while it's updated in the background.
+func (item *MenuItem) Toggle() (checked bool) {
+	checked = item.modify(func(s *itemState) { s.checked = !s.checked }).checked
 	item.update()
+	return checked
+}
+
+// CompareAndSwapChecked sets the check mark of a menu item to new only if it's currently equal to old.
+// It reports whether the check mark was changed.
+func (item *MenuItem) CompareAndSwapChecked(old, new bool) (swapped bool) {
+	item.modify(func(s *itemState) {
+		swapped = s.checked == old
+		if swapped {
+			s.checked = new
+		}
+	})
+	if swapped {
+		item.update()
+	}
+	return swapped
+}
+
+// OnClick sets the handler to be called when the menu item is clicked, nil removes the handler.
+// Handlers of all menu items are called one by one in the order the clicks arrived
+// on a dedicated dispatcher goroutine, so no click is ever dropped, but a slow
+// handler delays the handling of the next clicks.
+// Handlers may safely call any function of this package.
+// ClickedCh is notified as well, regardless of the handler.
+func (item *MenuItem) OnClick(handler func(ClickEvent)) {
+	if handler == nil {
+		item.onClick.Store(nil)
+		return
+	}
+	item.onClick.Store(&handler)
+}
+
+// OnCheckedChanged sets the handler to be called with the new state when the check mark
+// of the menu item is changed by a click (see SetAutoToggle), by a bound variable
+// or by any function of the menu item. nil removes the handler.
+// The handlers are called on the same dispatcher goroutine as OnClick handlers and
+// in the same order as the changes were made.
+func (item *MenuItem) OnCheckedChanged(handler func(checked bool)) {
+	if handler == nil {
+		item.onCheckedChanged.Store(nil)
+		return
+	}
+	item.onCheckedChanged.Store(&handler)
 }
 
-// update propagates changes on a menu item to systray
+// SetAutoToggle enables or disables the automatic toggling of the check mark when the menu item
+// is clicked. The check mark is toggled before the click is delivered to ClickedCh and
+// the OnClick handler, so they see the new state.
+// Use OnCheckedChanged to get the new state.
+func (item *MenuItem) SetAutoToggle(enabled bool) {
+	item.autoToggle.Store(enabled)
+}
+
+// bindPollInterval is the interval of checking the bound variables for changes
+const bindPollInterval = 100 * time.Millisecond
+
+// binding keeps a menu item check mark and a variable in sync
+type binding struct {
+	value *atomic.Bool
+	// lock guards last and orders the writes of the variable
+	lock sync.Mutex
+	// last is the last synchronized value
+	last bool
+}
+
+// Bind keeps the check mark of the menu item and the variable in sync in both directions:
+// the variable is updated right after the check mark is changed, and the check mark is updated
+// when the variable change is detected (the bound variables are checked every 100 ms).
+// The check mark takes the current value of the variable when Bind is called.
+// Only one variable can be bound to a menu item, nil unbinds the current one.
+// The binding ends when the menu item is removed.
+func (item *MenuItem) Bind(value *atomic.Bool) {
+	var b *binding
+	if value != nil {
+		b = &binding{value: value, last: value.Load()}
+	}
+	if old := item.binding.Swap(b); old != nil {
+		bindings.remove(old)
+	}
+	if b == nil {
+		return
+	}
+	item.setChecked(b.last)
+	b.itemChanged(item)
+	bindings.add(b, item)
+}
+
+// setChecked sets the check mark and returns the resulting state
+func (item *MenuItem) setChecked(checked bool) bool {
+	if item.CompareAndSwapChecked(!checked, checked) {
+		return checked
+	}
+	return item.Checked()
+}
+
+// itemChanged stores the check mark state to the bound variable. The state is read under
+// the lock, so the variable gets the latest state when the check mark is changed concurrently.
+func (b *binding) itemChanged(item *MenuItem) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.last = item.Checked()
+	b.value.Store(b.last)
+}
+
+// poll applies the change of the bound variable to the menu item check mark,
+// the binding is dropped when the menu item is removed
+func (b *binding) poll(item *MenuItem) {
+	if !item.registered() {
+		item.binding.CompareAndSwap(b, nil)
+		bindings.remove(b)
+		return
+	}
+	b.lock.Lock()
+	value := b.value.Load()
+	changed := value != b.last
+	b.lock.Unlock()
+	if changed {
+		item.setChecked(value)
+	}
+}
+
+// bindings polls the variables bound to the menu items of all trays
+var bindings = &bindingPoller{items: map[*binding]*MenuItem{}}
+
+// bindingPoller checks all bound variables with one ticker, it runs only while there are bindings
+type bindingPoller struct {
+	lock    sync.Mutex
+	items   map[*binding]*MenuItem
+	running bool
+}
+
+func (p *bindingPoller) add(b *binding, item *MenuItem) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.items[b] = item
+	if !p.running {
+		p.running = true
+		go p.run()
+	}
+}
+
+func (p *bindingPoller) remove(b *binding) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.items, b)
+}
+
+func (p *bindingPoller) run() {
+	ticker := time.NewTicker(bindPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.lock.Lock()
+		if len(p.items) == 0 {
+			p.running = false
+			p.lock.Unlock()
+			return
+		}
+		items := maps.Clone(p.items)
+		p.lock.Unlock()
+		for b, item := range items {
+			b.poll(item)
+		}
+	}
+}
+
+// update propagates changes on a menu item to systray. Changes of removed items are not propagated.
 func (item *MenuItem) update() {
-	menuItemsLock.Lock()
-	menuItems[item.id] = item
-	menuItemsLock.Unlock()
-	addOrUpdateMenuItem(item)
-}
-
-func systrayMenuItemSelected(id uint32) {
-	menuItemsLock.RLock()
-	item, ok := menuItems[id]
-	menuItemsLock.RUnlock()
-	if !ok {
-		log.Printf("systray error: no menu item with ID %d\n", id)
+	if item.registered() {
+		addOrUpdateMenuItem(item)
+	}
+}
+
+// menuItemSelected handles the click on the menu item of the tray
+func (t *Tray) menuItemSelected(id uint32, timestamp uint32, data interface{}) {
+	item := t.FindItem(id)
+	if item == nil {
+		logger().Warn("clicked menu item not found", "item", id)
 		return
 	}
+	if item.autoToggle.Load() {
+		item.Toggle()
+	}
+	if handler := item.onClick.Load(); handler != nil {
+		event := ClickEvent{Item: item, Timestamp: timestamp, Data: data}
+		clickDispatcher.dispatch(func() { (*handler)(event) })
+	}
+	t.events.publish(Event{Type: EventClick, ItemID: id, Item: item, Timestamp: timestamp, Data: data})
 	select {
 	case item.ClickedCh <- struct{}{}:
 	// in case no one waiting for the channel
@@ -14,14 +14,38 @@ void setInternalLoop(bool);
 import "C"
 
 import (
+	"fmt"
+	"image"
 	"unsafe"
+
+	"github.com/godbus/dbus/v5"
 )
 
-// SetTemplateIcon sets the systray icon as a template icon (on Mac), falling back
-// to a regular icon on other platforms.
-// templateIconBytes and regularIconBytes should be the content of .ico for windows and
-// .ico/.jpg/.png for other platforms.
-func SetTemplateIcon(templateIconBytes []byte, regularIconBytes []byte) {
+// tray is the platform specific part of the tray, macOS has only the default tray
+type tray struct{}
+
+// multipleTrays means that New can create additional trays
+const multipleTrays = false
+
+func newNativeTray(*Tray) *tray {
+	return &tray{}
+}
+
+func (*tray) setBusAddress(string) {
+}
+
+// WithConn does nothing, the caller provided D-Bus connection is only used on Linux.
+func WithConn(*dbus.Conn) Option {
+	return func(*Tray) {}
+}
+
+// SetID does nothing, the ID is only available on Linux.
+func (*Tray) SetID(id string) {
+}
+
+// SetTemplateIcon sets the tray icon as a template icon, see the package level SetTemplateIcon.
+func (t *Tray) SetTemplateIcon(templateIconBytes []byte, regularIconBytes []byte) {
+	t.stopAnimation()
 	cstr := (*C.char)(unsafe.Pointer(&templateIconBytes[0]))
 	C.setIcon(cstr, (C.int)(len(templateIconBytes)), true)
 }
@@ -42,23 +66,34 @@ func (item *MenuItem) SetTemplateIcon(templateIconBytes []byte, regularIconBytes
 	C.setMenuItemIcon(cstr, (C.int)(len(templateIconBytes)), C.int(item.id), true)
 }
 
-func registerSystray() {
+func (*Tray) registerSystray() error {
 	C.registerSystray()
+	return nil
 }
 
-func nativeLoop() {
+func (*Tray) nativeLoop() {
 	C.nativeLoop()
 }
 
-func nativeEnd() {
+func (*Tray) nativeLoopE() error {
+	C.nativeLoop()
+	return nil
+}
+
+func (*Tray) nativeEnd() {
 	C.nativeEnd()
 }
 
-func nativeStart() {
+func (*Tray) nativeStart() {
+	C.nativeStart()
+}
+
+func (*Tray) nativeStartE() error {
 	C.nativeStart()
+	return nil
 }
 
-func quit() {
+func (*Tray) quit() {
 	C.quit()
 }
 
@@ -66,36 +101,50 @@ func setInternalLoop(internal bool) {
 	C.setInternalLoop(C.bool(internal))
 }
 
-// SetIcon sets the systray icon.
-// iconBytes should be the content of .ico for windows and .ico/.jpg/.png
-// for other platforms.
-func SetIcon(iconBytes []byte) {
+func (*Tray) nativeReset() {
+}
+
+func (*Tray) beginBatch() {
+}
+
+func (*Tray) commitBatch() {
+}
+
+// setIcon sets the tray icon, the error wraps ErrBadIcon when the icon is empty.
+// The current animation isn't stopped.
+func (*Tray) setIcon(iconBytes []byte) error {
+	if len(iconBytes) == 0 {
+		return fmt.Errorf("%w: empty icon", ErrBadIcon)
+	}
 	cstr := (*C.char)(unsafe.Pointer(&iconBytes[0]))
 	C.setIcon(cstr, (C.int)(len(iconBytes)), false)
+	return nil
 }
 
-// SetTitle sets the systray title, only available on Mac and Linux.
-func SetTitle(title string) {
+// SetTitleE sets the tray title like SetTitle does, it never fails on Mac.
+func (*Tray) SetTitleE(title string) error {
 	C.setTitle(C.CString(title))
+	return nil
 }
 
-// SetTooltip sets the systray tooltip to display on mouse hover of the tray icon,
-// only available on Mac and Windows.
-func SetTooltip(tooltip string) {
+// SetTooltipE sets the tray tooltip like SetTooltip does, it never fails on Mac.
+func (*Tray) SetTooltipE(tooltip string) error {
 	C.setTooltip(C.CString(tooltip))
+	return nil
 }
 
 func addOrUpdateMenuItem(item *MenuItem) {
+	state := item.state.Load()
 	var disabled C.short
-	if item.disabled {
+	if state.disabled {
 		disabled = 1
 	}
 	var checked C.short
-	if item.checked {
+	if state.checked {
 		checked = 1
 	}
 	var isCheckable C.short
-	if item.isCheckable {
+	if state.isCheckable {
 		isCheckable = 1
 	}
 	var parentID uint32 = 0
@@ -105,15 +154,15 @@ func addOrUpdateMenuItem(item *MenuItem) {
 	C.add_or_update_menu_item(
 		C.int(item.id),
 		C.int(parentID),
-		C.CString(item.title),
-		C.CString(item.tooltip),
+		C.CString(state.title),
+		C.CString(state.tooltip),
 		disabled,
 		checked,
 		isCheckable,
 	)
 }
 
-func addSeparator(id uint32, parent uint32) {
+func (*Tray) addSeparator(id uint32, parent uint32) {
 	C.add_separator(C.int(id), C.int(parent))
 }
 
@@ -135,21 +184,94 @@ func removeMenuItem(item *MenuItem) {
 	)
 }
 
-func resetMenu() {
+func (*Tray) resetMenu() {
 	C.reset_menu()
 }
 
 //export systray_ready
 func systray_ready() {
-	systrayReady()
+	defaultTray.registration.set(StateRegistered)
+	defaultTray.ready(ReadyInfo{Registered: true, HostPresent: true})
 }
 
 //export systray_on_exit
 func systray_on_exit() {
-	runSystrayExit()
+	defaultTray.runExit()
 }
 
 //export systray_menu_item_selected
 func systray_menu_item_selected(cID C.int) {
-	systrayMenuItemSelected(uint32(cID))
+	defaultTray.menuItemSelected(uint32(cID), 0, nil)
+}
+
+func (t *Tray) setIconImage(img image.Image) error {
+	iconBytes, err := encodeIcon(img)
+	if err != nil {
+		return err
+	}
+	return t.setIcon(iconBytes)
+}
+
+func (*Tray) setAttentionIconImage(image.Image) error {
+	return nil
+}
+
+func (*Tray) setStatus(Status) error {
+	return nil
+}
+
+func encodeIcon(img image.Image) ([]byte, error) {
+	return encodePNG(img)
+}
+
+func iconCacheStats() IconCacheStats {
+	return IconCacheStats{}
+}
+
+// iconFrame is the encoded frame of the icon animation
+type iconFrame = []byte
+
+func decodeFrame(data []byte) (iconFrame, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%w: empty icon", ErrBadIcon)
+	}
+	return data, nil
+}
+
+func imageFrame(img image.Image) (iconFrame, error) {
+	return encodeIcon(img)
+}
+
+func (t *Tray) showFrame(frame iconFrame) error {
+	return t.setIcon(frame)
+}
+
+// passive is always false, the status is only available on Linux
+func (*Tray) passive() bool {
+	return false
+}
+
+// setBadge does nothing, the badge is only available on Linux.
+func (*Tray) setBadge(int) error {
+	return nil
+}
+
+// setBadgeStyle does nothing, the badge is only available on Linux.
+func (*Tray) setBadgeStyle(BadgeStyle) error {
+	return nil
+}
+
+// setProgress does nothing, the progress indicator is only available on Linux.
+func (*Tray) setProgress(float64) error {
+	return nil
+}
+
+// clearProgress does nothing, the progress indicator is only available on Linux.
+func (*Tray) clearProgress() error {
+	return nil
+}
+
+// setProgressStyle does nothing, the progress indicator is only available on Linux.
+func (*Tray) setProgressStyle(ProgressStyle) error {
+	return nil
 }
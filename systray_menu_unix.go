@@ -3,8 +3,7 @@
 package systray
 
 import (
-	"log"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/godbus/dbus/v5"
@@ -16,12 +15,13 @@ import (
 // SetIcon sets the icon of a menu item.
 // iconBytes should be the content of .ico/.jpg/.png
 func (item *MenuItem) SetIcon(iconBytes []byte) {
-	instance.menuLock.Lock()
-	defer instance.menuLock.Unlock()
-	m, exists := findLayout(int32(item.id))
+	t := item.tray.native
+	t.menuLock.Lock()
+	defer t.menuLock.Unlock()
+	m, exists := t.findLayout(int32(item.id))
 	if exists {
 		m.V1["icon-data"] = dbus.MakeVariant(iconBytes)
-		refresh()
+		t.refresh()
 	}
 }
 
@@ -46,13 +46,23 @@ func copyLayout(in *menuLayout, depth int32) *menuLayout {
 	return &out
 }
 
+// servedLayout finds the layout served to the host: the snapshot taken before the batch
+// while the batch is running, so the host never gets a half-built menu.
+// It is always called after t.menuLock.Lock().
+func (t *tray) servedLayout(id int32) (*menuLayout, bool) {
+	if t.menuSnapshot != nil {
+		return findLayoutIn(t.menuSnapshot, id)
+	}
+	return t.findLayout(id)
+}
+
 // GetLayout is com.canonical.dbusmenu.GetLayout method.
 func (t *tray) GetLayout(parentID int32, recursionDepth int32, _ []string) (revision uint32, layout menuLayout, err *dbus.Error) {
-	instance.menuLock.Lock()
-	defer instance.menuLock.Unlock()
-	if m, ok := findLayout(parentID); ok {
+	t.menuLock.Lock()
+	defer t.menuLock.Unlock()
+	if m, ok := t.servedLayout(parentID); ok {
 		// return copy of menu layout to prevent panic from concurrent access to layout
-		return instance.menuVersion, *copyLayout(m, recursionDepth), nil
+		return t.menuVersion, *copyLayout(m, recursionDepth), nil
 	}
 	return
 }
@@ -62,10 +72,10 @@ func (t *tray) GetGroupProperties(ids []int32, _ []string) (properties []struct
 	V0 int32
 	V1 map[string]dbus.Variant
 }, err *dbus.Error) {
-	instance.menuLock.Lock()
-	defer instance.menuLock.Unlock()
+	t.menuLock.Lock()
+	defer t.menuLock.Unlock()
 	for _, id := range ids {
-		if m, ok := findLayout(id); ok {
+		if m, ok := t.servedLayout(id); ok {
 			p := struct {
 				V0 int32
 				V1 map[string]dbus.Variant
@@ -84,9 +94,9 @@ func (t *tray) GetGroupProperties(ids []int32, _ []string) (properties []struct
 
 // GetProperty is com.canonical.dbusmenu.GetProperty method.
 func (t *tray) GetProperty(id int32, name string) (value dbus.Variant, err *dbus.Error) {
-	instance.menuLock.Lock()
-	defer instance.menuLock.Unlock()
-	if m, ok := findLayout(id); ok {
+	t.menuLock.Lock()
+	defer t.menuLock.Unlock()
+	if m, ok := t.servedLayout(id); ok {
 		if p, ok := m.V1[name]; ok {
 			return p, nil
 		}
@@ -96,12 +106,30 @@ func (t *tray) GetProperty(id int32, name string) (value dbus.Variant, err *dbus
 
 // Event is com.canonical.dbusmenu.Event method.
 func (t *tray) Event(id int32, eventID string, data dbus.Variant, timestamp uint32) (err *dbus.Error) {
-	if eventID == "clicked" {
-		systrayMenuItemSelected(uint32(id))
-	}
+	t.menuEvent(id, eventID, data, timestamp)
 	return
 }
 
+// menuEvent handles the dbusmenu event
+func (t *tray) menuEvent(id int32, eventID string, data dbus.Variant, timestamp uint32) {
+	switch eventID {
+	case "clicked":
+		t.owner.menuItemSelected(uint32(id), timestamp, data.Value())
+	case "opened", "closed":
+		event := Event{
+			Type:      EventMenuOpened,
+			ItemID:    uint32(id),
+			Item:      t.owner.FindItem(uint32(id)),
+			Timestamp: timestamp,
+			Data:      data.Value(),
+		}
+		if eventID == "closed" {
+			event.Type = EventMenuClosed
+		}
+		t.owner.events.publish(event)
+	}
+}
+
 // EventGroup is com.canonical.dbusmenu.EventGroup method.
 func (t *tray) EventGroup(events []struct {
 	V0 int32
@@ -110,9 +138,7 @@ func (t *tray) EventGroup(events []struct {
 	V3 uint32
 }) (idErrors []int32, err *dbus.Error) {
 	for _, event := range events {
-		if event.V1 == "clicked" {
-			systrayMenuItemSelected(uint32(event.V0))
-		}
+		t.menuEvent(event.V0, event.V1, event.V2, event.V3)
 	}
 	return
 }
@@ -127,13 +153,13 @@ func (t *tray) AboutToShowGroup(ids []int32) (updatesNeeded []int32, idErrors []
 	return
 }
 
-func createMenuPropSpec() map[string]map[string]*prop.Prop {
-	instance.menuLock.Lock()
-	defer instance.menuLock.Unlock()
+func (t *tray) createMenuPropSpec() map[string]map[string]*prop.Prop {
+	t.menuLock.Lock()
+	defer t.menuLock.Unlock()
 	return map[string]map[string]*prop.Prop{
 		"com.canonical.dbusmenu": {
 			"Version": {
-				Value:    instance.menuVersion,
+				Value:    t.menuVersion,
 				Writable: true,
 				Emit:     prop.EmitTrue,
 				Callback: nil,
@@ -169,9 +195,10 @@ type menuLayout = struct {
 
 func addOrUpdateMenuItem(item *MenuItem) {
 	var layout *menuLayout
-	instance.menuLock.Lock()
-	defer instance.menuLock.Unlock()
-	m, exists := findLayout(int32(item.id))
+	t := item.tray.native
+	t.menuLock.Lock()
+	defer t.menuLock.Unlock()
+	m, exists := t.findLayout(int32(item.id))
 	if exists {
 		layout = m
 	} else {
@@ -181,9 +208,9 @@ func addOrUpdateMenuItem(item *MenuItem) {
 			V2: []dbus.Variant{},
 		}
 
-		parent := instance.menu
+		parent := t.menu
 		if item.parent != nil {
-			m, ok := findLayout(int32(item.parent.id))
+			m, ok := t.findLayout(int32(item.parent.id))
 			if ok {
 				parent = m
 				parent.V1["children-display"] = dbus.MakeVariant("submenu")
@@ -193,13 +220,14 @@ func addOrUpdateMenuItem(item *MenuItem) {
 	}
 
 	applyItemToLayout(item, layout)
-	refresh()
+	t.refresh()
 }
 
-func addSeparator(id uint32, parent uint32) {
-	instance.menuLock.Lock()
-	defer instance.menuLock.Unlock()
-	menu, _ := findLayout(int32(parent))
+func (tr *Tray) addSeparator(id uint32, parent uint32) {
+	t := tr.native
+	t.menuLock.Lock()
+	defer t.menuLock.Unlock()
+	menu, _ := t.findLayout(int32(parent))
 	layout := &menuLayout{
 		V0: int32(id),
 		V1: map[string]dbus.Variant{
@@ -208,12 +236,14 @@ func addSeparator(id uint32, parent uint32) {
 		V2: []dbus.Variant{},
 	}
 	menu.V2 = append(menu.V2, dbus.MakeVariant(layout))
-	refresh()
+	t.refresh()
 }
 
-func applyItemToLayout(in *MenuItem, out *menuLayout) {
+func applyItemToLayout(item *MenuItem, out *menuLayout) {
+	in := item.state.Load()
 	out.V1["enabled"] = dbus.MakeVariant(!in.disabled)
 	out.V1["label"] = dbus.MakeVariant(in.title)
+	out.V1["visible"] = dbus.MakeVariant(!in.hidden)
 
 	if in.isCheckable {
 		out.V1["toggle-type"] = dbus.MakeVariant("checkmark")
@@ -228,11 +258,16 @@ func applyItemToLayout(in *MenuItem, out *menuLayout) {
 	}
 }
 
-func findLayout(id int32) (*menuLayout, bool) {
+func (t *tray) findLayout(id int32) (*menuLayout, bool) {
+	return findLayoutIn(t.menu, id)
+}
+
+// findLayoutIn finds the layout of the menu item in the root layout, 0 is the root layout itself
+func findLayoutIn(root *menuLayout, id int32) (*menuLayout, bool) {
 	if id == 0 {
-		return instance.menu, true
+		return root, true
 	}
-	return findSubLayout(id, instance.menu.V2)
+	return findSubLayout(id, root.V2)
 }
 
 func findSubLayout(id int32, vals []dbus.Variant) (*menuLayout, bool) {
@@ -271,12 +306,13 @@ func removeSubLayout(id int32, vals []dbus.Variant) ([]dbus.Variant, bool) {
 }
 
 func removeMenuItem(item *MenuItem) {
-	instance.menuLock.Lock()
-	defer instance.menuLock.Unlock()
+	t := item.tray.native
+	t.menuLock.Lock()
+	defer t.menuLock.Unlock()
 
-	parent := instance.menu
+	parent := t.menu
 	if item.parent != nil {
-		m, ok := findLayout(int32(item.parent.id))
+		m, ok := t.findLayout(int32(item.parent.id))
 		if !ok {
 			return
 		}
@@ -285,84 +321,123 @@ func removeMenuItem(item *MenuItem) {
 
 	if items, removed := removeSubLayout(int32(item.id), parent.V2); removed {
 		parent.V2 = items
-		refresh()
+		t.refresh()
 	}
 }
 
 func hideMenuItem(item *MenuItem) {
-	instance.menuLock.Lock()
-	defer instance.menuLock.Unlock()
-	m, exists := findLayout(int32(item.id))
-	if exists {
-		m.V1["visible"] = dbus.MakeVariant(false)
-		refresh()
-	}
+	addOrUpdateMenuItem(item)
 }
 
 func showMenuItem(item *MenuItem) {
-	instance.menuLock.Lock()
-	defer instance.menuLock.Unlock()
-	m, exists := findLayout(int32(item.id))
-	if exists {
-		m.V1["visible"] = dbus.MakeVariant(true)
-		refresh()
+	addOrUpdateMenuItem(item)
+}
+
+// refresher coalesces any number of menu changes into one layout update.
+// Changes only set the dirty flag and wake up the run loop, so they never block
+// and can be safely requested while the tray menuLock is held.
+type refresher struct {
+	dirty atomic.Bool
+	wake  chan struct{}
+}
+
+func newRefresher() *refresher {
+	return &refresher{wake: make(chan struct{}, 1)}
+}
+
+// request marks the menu as changed and wakes up the run loop, it never blocks.
+func (r *refresher) request() {
+	r.dirty.Store(true)
+	select {
+	case r.wake <- struct{}{}:
+	default: // the run loop is already woken up
 	}
 }
 
-var delay = 5 * time.Millisecond // delay before real refresh
-var change = make(chan struct{}, 100)
-var initialize sync.Once
+// run calls flush for the requested changes until stop is closed.
+// The flush is delayed by the minimal refresh latency after the last change
+// but no more than by the maximal refresh latency after the first one.
+func (r *refresher) run(flush func(), stop <-chan struct{}) {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	var deadline time.Time
+	for {
+		select {
+		case <-r.wake:
+			now := time.Now()
+			minLatency, maxLatency := refreshLatency()
+			if deadline.IsZero() {
+				deadline = now.Add(maxLatency)
+			}
+			timer.Reset(min(minLatency, deadline.Sub(now)))
+		case <-timer.C:
+			deadline = time.Time{}
+			if r.dirty.Swap(false) {
+				flush()
+			}
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
 
-// refresh is always called after instance.menuLock.Lock().
-func refresh() {
-	if instance.conn == nil || instance.menuProps == nil {
+// refresh is always called after t.menuLock.Lock().
+func (t *tray) refresh() {
+	t.menuChanged = true
+	t.refresher.request()
+}
+
+func (t *tray) doRefresh() {
+	// as doRefresh is executed in separate goroutine it have to lock t.menuLock,
+	// the batch can't begin till the menu is published then
+	t.menuLock.Lock()
+	defer t.menuLock.Unlock()
+	t.lock.Lock()
+	if t.batchDepth > 0 {
+		// the menu is published on the batch commit
+		t.pendingMenu = true
+		t.lock.Unlock()
 		return
 	}
-	initialize.Do(func() {
-		go func() {
-			timer := time.NewTimer(time.Hour)
-			timer.Stop()
-			for {
-				select {
-				case <-change:
-					timer.Reset(delay)
-				case <-timer.C:
-					timer.Stop()
-					doRefresh()
-				case <-quitChan:
-					return
-				}
-			}
-		}()
-	})
-	change <- struct{}{}
+	conn, menuProps := t.conn, t.menuProps
+	t.lock.Unlock()
+	t.publishMenu(conn, menuProps)
 }
 
-func doRefresh() {
-	// as doRefresh is executed in separate goroutine it have to lock instance.menuLock
-	instance.menuLock.Lock()
-	defer instance.menuLock.Unlock()
-	instance.menuVersion++
-	dbusErr := instance.menuProps.Set("com.canonical.dbusmenu", "Version",
-		dbus.MakeVariant(instance.menuVersion))
+// publishMenu publishes the new layout revision of the changed menu,
+// it is always called after t.menuLock.Lock().
+func (t *tray) publishMenu(conn *dbus.Conn, menuProps *prop.Properties) {
+	if conn == nil || menuProps == nil {
+		return
+	}
+	if !t.menuChanged {
+		// the changes are already published by the batch commit or the refresher
+		return
+	}
+	t.menuChanged = false
+	t.menuVersion++
+	// the whole layout is updated, so the updated item is the root one
+	body := &menu.Dbusmenu_LayoutUpdatedSignalBody{Revision: t.menuVersion}
+	dbusErr := menuProps.Set("com.canonical.dbusmenu", "Version",
+		dbus.MakeVariant(t.menuVersion))
 	if dbusErr != nil {
-		log.Printf("systray error: failed to update menu version: %s\n", dbusErr)
+		logger().Error("failed to update menu version", "method", "org.freedesktop.DBus.Properties.Set", "path", t.menuPath, "err", dbusErr)
 		return
 	}
-	err := menu.Emit(instance.conn, &menu.Dbusmenu_LayoutUpdatedSignal{
-		Path: menuPath,
-		Body: &menu.Dbusmenu_LayoutUpdatedSignalBody{
-			Revision: instance.menuVersion,
-		},
+	err := menu.Emit(conn, &menu.Dbusmenu_LayoutUpdatedSignal{
+		Path: dbus.ObjectPath(t.menuPath),
+		Body: body,
 	})
 	if err != nil {
-		log.Printf("systray error: failed to emit layout updated signal: %s\n", err)
+		logger().Error("failed to emit layout updated signal", "method", "com.canonical.dbusmenu.LayoutUpdated", "path", t.menuPath, "err", err)
 	}
 }
 
-func resetMenu() {
-	instance.menuLock.Lock()
-	defer instance.menuLock.Unlock()
-	instance.menu = &menuLayout{}
-	refresh()
+func (tr *Tray) resetMenu() {
+	t := tr.native
+	t.menuLock.Lock()
+	defer t.menuLock.Unlock()
+	t.menu = &menuLayout{}
+	t.refresh()
 }
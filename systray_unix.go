@@ -8,12 +8,18 @@ package systray
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"image"
-	_ "image/png" // used only here
-	"log"
+	"image/color"
+	_ "image/gif" // the decoders are used by convertToPixels
+	_ "image/jpeg"
+	_ "image/png"
 	"os"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/godbus/dbus/v5"
 	"github.com/godbus/dbus/v5/introspect"
@@ -24,114 +30,332 @@ import (
 )
 
 const (
+	// path and menuPath are the object paths of the default tray,
+	// the paths of additional trays have the tray index appended
 	path     = "/StatusNotifierItem"
 	menuPath = "/StatusNotifierMenu"
 )
 
-var (
-	// to signal quitting the internal main loop
-	quitChan = make(chan struct{})
+// multipleTrays means that New can create additional trays
+const multipleTrays = true
 
-	// instance is the current instance of our DBus tray server
-	instance = &tray{menu: &menuLayout{}, menuVersion: 1}
-)
+// trayIndex is the index of the last created tray, the default tray has index 1
+var trayIndex atomic.Uint32
 
-// SetTemplateIcon sets the systray icon as a template icon (on macOS), falling back
-// to a regular icon on other platforms.
-// templateIconBytes and iconBytes should be the content of .ico for windows and
-// .ico/.jpg/.png for other platforms.
-func SetTemplateIcon(templateIconBytes []byte, regularIconBytes []byte) {
+// newNativeTray creates the DBus tray server of the tray
+func newNativeTray(owner *Tray) *tray {
+	t := &tray{
+		owner:       owner,
+		index:       trayIndex.Add(1),
+		path:        path,
+		menuPath:    menuPath,
+		menu:        &menuLayout{},
+		menuVersion: 1,
+		quit:        make(chan struct{}),
+		refresher:   newRefresher(),
+
+		checkInterval: registrationCheckInterval,
+	}
+	if t.index > 1 {
+		t.path = fmt.Sprintf("%s%d", path, t.index)
+		t.menuPath = fmt.Sprintf("%s%d", menuPath, t.index)
+	}
+	return t
+}
+
+// setIcon decodes the icon and sets it, the current animation isn't stopped
+func (tr *Tray) setIcon(iconBytes []byte) error {
+	iconData, err := icons.decode(iconBytes)
+	if err != nil {
+		return err
+	}
+	return tr.native.setIconData(iconData)
+}
+
+// setIconImage sets the tray icon from the image without encoding it
+func (tr *Tray) setIconImage(img image.Image) error {
+	return tr.native.setIconData(pixmapsForImage(img))
+}
+
+func (t *tray) setIconData(iconData []PX) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if equalPixmaps(t.iconData, iconData) {
+		suppressedUpdates.Add(1)
+		return nil
+	}
+	t.iconData = iconData
+	return t.iconChanged()
+}
+
+// setAttentionIconImage sets the icon shown while the tray needs attention
+func (tr *Tray) setAttentionIconImage(img image.Image) error {
+	t := tr.native
+	attentionIconData := pixmapsForImage(img)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if equalPixmaps(t.attentionIconData, attentionIconData) {
+		suppressedUpdates.Add(1)
+		return nil
+	}
+	t.attentionIconData = attentionIconData
+	t.stateGen++
+	if t.batchDepth > 0 {
+		t.pendingAttentionIcon = true
+		return nil
+	}
+	return t.applyAttentionIcon()
+}
+
+// applyAttentionIcon publishes the attention icon, it is always called after t.lock.Lock().
+func (t *tray) applyAttentionIcon() error {
+	if t.props == nil {
+		return nil
+	}
+	t.props.SetMust("org.kde.StatusNotifierItem", "AttentionIconPixmap", published(t.attentionIconData))
+	if t.conn == nil {
+		return nil
+	}
+	err := notifier.Emit(t.conn, &notifier.StatusNotifierItem_NewAttentionIconSignal{
+		Path: dbus.ObjectPath(t.path),
+		Body: &notifier.StatusNotifierItem_NewAttentionIconSignalBody{},
+	})
+	if err != nil {
+		return t.callError("org.kde.StatusNotifierItem.NewAttentionIcon", fmt.Errorf("failed to emit new attention icon signal: %w", err))
+	}
+	return nil
+}
+
+// setStatus sets the tray status
+func (tr *Tray) setStatus(status Status) error {
+	t := tr.native
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.status == status {
+		suppressedUpdates.Add(1)
+		return nil
+	}
+	t.status = status
+	t.stateGen++
+	if t.batchDepth > 0 {
+		t.pendingStatus = true
+		return nil
+	}
+	return t.applyStatus()
+}
+
+// applyStatus publishes the status, it is always called after t.lock.Lock().
+func (t *tray) applyStatus() error {
+	if t.props == nil {
+		return nil
+	}
+	t.props.SetMust("org.kde.StatusNotifierItem", "Status", t.status.String())
+	if t.conn == nil {
+		return nil
+	}
+	err := notifier.Emit(t.conn, &notifier.StatusNotifierItem_NewStatusSignal{
+		Path: dbus.ObjectPath(t.path),
+		Body: &notifier.StatusNotifierItem_NewStatusSignalBody{Status: t.status.String()},
+	})
+	if err != nil {
+		return t.callError("org.kde.StatusNotifierItem.NewStatus", fmt.Errorf("failed to emit new status signal: %w", err))
+	}
+	return nil
+}
+
+// SetTemplateIcon sets the tray icon, the template icon is only used on macOS.
+func (tr *Tray) SetTemplateIcon(templateIconBytes []byte, regularIconBytes []byte) {
 	// TODO handle the templateIconBytes?
-	SetIcon(regularIconBytes)
+	tr.SetIcon(regularIconBytes)
 }
 
-// SetIcon sets the systray icon.
-// iconBytes should be the content of .ico for windows and .ico/.jpg/.png
-// for other platforms.
-func SetIcon(iconBytes []byte) {
-	instance.lock.Lock()
-	instance.iconData = convertToPixels(iconBytes)
-	props := instance.props
-	conn := instance.conn
-	defer instance.lock.Unlock()
+// iconChanged publishes the icon after it or its decoration has changed, it is always called after t.lock.Lock().
+func (t *tray) iconChanged() error {
+	t.stateGen++
+	if t.batchDepth > 0 {
+		t.pendingIcon = true
+		return nil
+	}
+	return t.applyIcon()
+}
 
-	if props == nil {
-		return
+// applyIcon publishes the icon, it is always called after t.lock.Lock().
+func (t *tray) applyIcon() error {
+	if t.props == nil {
+		return nil
 	}
 
-	props.SetMust("org.kde.StatusNotifierItem", "IconPixmap",
-		[]PX{instance.iconData})
-	if conn == nil {
-		return
+	t.props.SetMust("org.kde.StatusNotifierItem", "IconPixmap",
+		t.decoratedIcon())
+	if t.conn == nil {
+		return nil
 	}
 
-	err := notifier.Emit(conn, &notifier.StatusNotifierItem_NewIconSignal{
-		Path: path,
+	err := notifier.Emit(t.conn, &notifier.StatusNotifierItem_NewIconSignal{
+		Path: dbus.ObjectPath(t.path),
 		Body: &notifier.StatusNotifierItem_NewIconSignalBody{},
 	})
 	if err != nil {
-		log.Printf("systray error: failed to emit new icon signal: %s\n", err)
-		return
+		return t.callError("org.kde.StatusNotifierItem.NewIcon", fmt.Errorf("failed to emit new icon signal: %w", err))
 	}
+	return nil
 }
 
-// SetID sets the technical ID of systray item, only available on Mac and Linux.
-// it must be called before Run otherwise ID will be "systray_<PID>"
-func SetID(id string) {
-	instance.lock.Lock()
-	defer instance.lock.Unlock()
-	instance.id = id
+// WithConn makes the tray use the given D-Bus connection instead of its own connection to the session bus.
+// The caller owns the connection: the tray never closes it and it quits with ErrConnectionLost
+// when the connection is lost. After quit the tray is hidden, but the watcher keeps listing it
+// until the connection is closed.
+func WithConn(conn *dbus.Conn) Option {
+	return func(tr *Tray) {
+		t := tr.native
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		t.extConn = conn
+	}
 }
 
-// SetTitle sets the systray title, only available on Mac and Linux.
-func SetTitle(t string) {
-	instance.lock.Lock()
-	instance.title = t
-	props := instance.props
-	conn := instance.conn
-	defer instance.lock.Unlock()
+func (t *tray) setBusAddress(address string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.busAddress = address
+}
 
-	if props == nil {
-		return
+// SetID sets the technical ID of the tray item, see the package level SetID.
+// The default ID of additional trays is "systray_<PID>_<tray index>".
+func (tr *Tray) SetID(id string) {
+	t := tr.native
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.id = id
+}
+
+// SetTitleE sets the tray title like SetTitle does, but returns the error instead of logging it.
+func (tr *Tray) SetTitleE(title string) error {
+	t := tr.native
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.title == title {
+		suppressedUpdates.Add(1)
+		return nil
 	}
-	dbusErr := props.Set("org.kde.StatusNotifierItem", "Title",
-		dbus.MakeVariant(t))
+	t.title = title
+	t.stateGen++
+	if t.batchDepth > 0 {
+		t.pendingTitle = true
+		return nil
+	}
+	return t.applyTitle()
+}
+
+// applyTitle publishes the title, it is always called after t.lock.Lock().
+func (t *tray) applyTitle() error {
+	if t.props == nil {
+		return nil
+	}
+	dbusErr := t.props.Set("org.kde.StatusNotifierItem", "Title",
+		dbus.MakeVariant(t.title))
 	if dbusErr != nil {
-		log.Printf("systray error: failed to set Title prop: %s\n", dbusErr)
-		return
+		return t.callError(propertiesSetMethod, fmt.Errorf("failed to set Title prop: %w", dbusErr))
 	}
 
-	if conn == nil {
-		return
+	if t.conn == nil {
+		return nil
 	}
 
-	err := notifier.Emit(conn, &notifier.StatusNotifierItem_NewTitleSignal{
-		Path: path,
+	err := notifier.Emit(t.conn, &notifier.StatusNotifierItem_NewTitleSignal{
+		Path: dbus.ObjectPath(t.path),
 		Body: &notifier.StatusNotifierItem_NewTitleSignalBody{},
 	})
 	if err != nil {
-		log.Printf("systray error: failed to emit new title signal: %s\n", err)
-		return
+		return t.callError("org.kde.StatusNotifierItem.NewTitle", fmt.Errorf("failed to emit new title signal: %w", err))
 	}
+	return nil
 }
 
-// SetTooltip sets the systray tooltip to display on mouse hover of the tray icon,
-// only available on Mac, Windows and Linux.
-func SetTooltip(tooltipTitle string) {
-	instance.lock.Lock()
-	instance.tooltipTitle = tooltipTitle
-	props := instance.props
-	defer instance.lock.Unlock()
+// SetTooltipE sets the tray tooltip like SetTooltip does, but returns the error instead of logging it.
+func (tr *Tray) SetTooltipE(tooltipTitle string) error {
+	t := tr.native
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.tooltipTitle == tooltipTitle {
+		suppressedUpdates.Add(1)
+		return nil
+	}
+	t.tooltipTitle = tooltipTitle
+	t.stateGen++
+	if t.batchDepth > 0 {
+		t.pendingTooltip = true
+		return nil
+	}
+	return t.applyTooltip()
+}
 
-	if props == nil {
-		return
+// applyTooltip publishes the tooltip, it is always called after t.lock.Lock().
+func (t *tray) applyTooltip() error {
+	if t.props == nil {
+		return nil
 	}
-	dbusErr := props.Set("org.kde.StatusNotifierItem", "ToolTip",
-		dbus.MakeVariant(tooltip{V2: tooltipTitle}))
+	dbusErr := t.props.Set("org.kde.StatusNotifierItem", "ToolTip",
+		dbus.MakeVariant(tooltip{V2: t.tooltipTitle}))
 	if dbusErr != nil {
-		log.Printf("systray error: failed to set ToolTip prop: %s\n", dbusErr)
+		return t.callError(propertiesSetMethod, fmt.Errorf("failed to set ToolTip prop: %w", dbusErr))
+	}
+	return nil
+}
+
+// beginBatch defers the changes till commitBatch, the host gets the menu snapshot meanwhile.
+// The menuLock is taken before the lock, so the batch can't start while the menu is published.
+func (tr *Tray) beginBatch() {
+	t := tr.native
+	t.menuLock.Lock()
+	defer t.menuLock.Unlock()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.batchDepth++
+	if t.batchDepth == 1 {
+		t.menuSnapshot = copyLayout(t.menu, -1)
+	}
+}
+
+func (tr *Tray) commitBatch() {
+	t := tr.native
+	t.menuLock.Lock()
+	defer t.menuLock.Unlock()
+	t.lock.Lock()
+	t.batchDepth--
+	if t.batchDepth > 0 {
+		t.lock.Unlock()
 		return
 	}
+	t.menuSnapshot = nil
+	var errs []error
+	if t.pendingIcon {
+		errs = append(errs, t.applyIcon())
+	}
+	if t.pendingTitle {
+		errs = append(errs, t.applyTitle())
+	}
+	if t.pendingTooltip {
+		errs = append(errs, t.applyTooltip())
+	}
+	if t.pendingAttentionIcon {
+		errs = append(errs, t.applyAttentionIcon())
+	}
+	if t.pendingStatus {
+		errs = append(errs, t.applyStatus())
+	}
+	if err := errors.Join(errs...); err != nil {
+		logger().Error("failed to apply batch changes", errorAttrs(err)...)
+	}
+	pendingMenu := t.pendingMenu
+	t.pendingIcon, t.pendingTitle, t.pendingTooltip, t.pendingMenu = false, false, false, false
+	t.pendingAttentionIcon, t.pendingStatus = false, false
+	conn, menuProps := t.conn, t.menuProps
+	t.lock.Unlock()
+
+	if pendingMenu {
+		t.publishMenu(conn, menuProps)
+	}
 }
 
 // SetTemplateIcon sets the icon of a menu item as a template icon (on macOS). On Windows and
@@ -146,61 +370,277 @@ func setInternalLoop(_ bool) {
 	// nothing to action on Linux
 }
 
-func registerSystray() {
+func (tr *Tray) registerSystray() error {
+	return nil
+}
+
+func (tr *Tray) nativeLoop() {
+	tr.nativeStart()
+	<-tr.native.quitChan()
+	tr.nativeEnd()
+}
+
+func (tr *Tray) nativeLoopE() error {
+	if _, err := tr.start(); err != nil {
+		tr.nativeEnd()
+		return err
+	}
+	<-tr.native.quitChan()
+	t := tr.native
+	t.lock.Lock()
+	err := t.connErr
+	t.lock.Unlock()
+	tr.nativeEnd()
+	return err
 }
 
-func nativeLoop() int {
-	nativeStart()
-	<-quitChan
-	nativeEnd()
-	return 0
+func (tr *Tray) nativeEnd() {
+	tr.runExit()
+	t := tr.native
+	t.lock.Lock()
+	// stop the background goroutines before closing the connection, so it's not reconnected
+	t.stop()
+	conn, ownConn, props := t.conn, t.ownConn, t.props
+	t.conn, t.props, t.menuProps = nil, nil, nil
+	t.lock.Unlock()
+	t.workers.Wait()
+	tr.registration.set(StateUnregistered)
+	if conn == nil {
+		return
+	}
+	t.teardown(conn, props)
+	if ownConn {
+		conn.Close()
+	}
 }
 
-func nativeEnd() {
-	runSystrayExit()
-	instance.conn.Close()
+// teardown removes the tray from the bus without closing the connection: the tray status is set
+// to Passive, so the host hides it right away, the objects are unexported and the bus name is released.
+// The watcher has no method to unregister the tray, it drops the tray when the unique name the tray
+// is registered with leaves the bus: right away for the own connection, which is closed after teardown,
+// but only when the caller closes the connection given by WithConn. Until then the host keeps the
+// Passive tray, and its calls to the unexported objects fail.
+func (t *tray) teardown(conn *dbus.Conn, props *prop.Properties) {
+	path, menuPath := dbus.ObjectPath(t.path), dbus.ObjectPath(t.menuPath)
+	props.SetMust("org.kde.StatusNotifierItem", "Status", "Passive")
+	errs := []error{
+		notifier.Emit(conn, &notifier.StatusNotifierItem_NewStatusSignal{
+			Path: path,
+			Body: &notifier.StatusNotifierItem_NewStatusSignalBody{Status: "Passive"},
+		}),
+		notifier.UnexportStatusNotifierItem(conn, path),
+		menu.UnexportDbusmenu(conn, menuPath),
+	}
+	for _, p := range []dbus.ObjectPath{path, menuPath} {
+		errs = append(errs,
+			conn.Export(nil, p, "org.freedesktop.DBus.Properties"),
+			conn.Export(nil, p, "org.freedesktop.DBus.Introspectable"),
+		)
+	}
+	if _, err := conn.ReleaseName(t.busName()); err != nil {
+		errs = append(errs, fmt.Errorf("failed to release name: %w", err))
+	}
+	if err := errors.Join(errs...); err != nil {
+		logger().Warn("failed to remove the tray from the bus", "path", t.path, "err", err)
+	}
 }
 
-func quit() {
-	close(quitChan)
+// busName returns the bus name of the tray
+func (t *tray) busName() string {
+	return fmt.Sprintf("org.kde.StatusNotifierItem-%d-%d", os.Getpid(), t.index)
 }
 
-func nativeStart() {
-	systrayReady()
-	conn, err := dbus.SessionBus()
+func (tr *Tray) quit() {
+	t := tr.native
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.stop()
+}
+
+// stop closes the quit channel if it's not closed yet, it is always called after t.lock.Lock().
+func (t *tray) stop() {
+	select {
+	case <-t.quit:
+	default:
+		close(t.quit)
+	}
+}
+
+// nativeReset drops the state of the finished run
+func (tr *Tray) nativeReset() {
+	t := tr.native
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.conn, t.props, t.menuProps, t.connErr = nil, nil, nil, nil
+	t.iconData, t.attentionIconData = nil, nil
+	t.title, t.tooltipTitle = "", ""
+	t.status = StatusActive
+	t.badge = 0
+	t.showProgress = false
+	t.stopProgressTimer()
+	t.quit = make(chan struct{})
+}
+
+func (tr *Tray) nativeStart() {
+	if _, err := tr.start(); err != nil {
+		// onReady is still called, as Run has no other way to let the application go on
+		logger().Error("failed to start systray", "err", err)
+		tr.ready(ReadyInfo{Err: err})
+	}
+}
+
+// connect returns the connection set by WithConn or connects to the bus,
+// every tray has its own connection, so quitting one tray doesn't break the others.
+// owned reports whether the tray owns the connection and has to close it.
+func (t *tray) connect() (conn *dbus.Conn, owned bool, err error) {
+	t.lock.Lock()
+	extConn, address := t.extConn, t.busAddress
+	t.lock.Unlock()
+	switch {
+	case extConn != nil:
+		if !extConn.Connected() {
+			return nil, false, errors.New("the connection is closed")
+		}
+		return extConn, false, nil
+	case address != "":
+		conn, err = dbus.Connect(address)
+	default:
+		conn, err = dbus.ConnectSessionBus()
+	}
+	return conn, err == nil, err
+}
+
+// nativeStartE starts the tray and returns the error it can't be started with
+// or the problems it has been started with, see start.
+func (tr *Tray) nativeStartE() error {
+	problems, err := tr.start()
 	if err != nil {
-		log.Printf("systray error: failed to connect to DBus: %v\n", err)
-		return
+		return err
+	}
+	return problems
+}
+
+// start connects to the session bus, exports the tray objects and registers the tray.
+// Failed name request and registration are the problems the tray is started with, they aren't
+// fatal: they are logged, the tray stays exported and gets registered when the watcher appears.
+// onReady is called once the registration has been attempted, it isn't called when the tray
+// can't be exported. The tray is reconnected when the connection is lost, see SetReconnectDelay.
+func (tr *Tray) start() (problems, err error) {
+	t := tr.native
+	quitChan := t.quitChan()
+	conn, nameErr, err := t.export(quitChan)
+	if errors.Is(err, errQuit) {
+		return nil, nil
 	}
-	err = notifier.ExportStatusNotifierItem(conn, path, &notifier.UnimplementedStatusNotifierItem{})
 	if err != nil {
-		log.Printf("systray error: failed to export status notifier item: %v\n", err)
+		return nil, err
+	}
+
+	go t.refresher.run(t.doRefresh, quitChan)
+	regErr := t.register(conn)
+	t.workers.Add(2)
+	go t.stayRegistered(conn, quitChan)
+	go tr.supervise(conn, quitChan)
+
+	state := tr.registration.get()
+	info := ReadyInfo{
+		Registered:  state == StateRegistered || state == StateNoHost,
+		HostPresent: state == StateRegistered,
+	}
+	if nameErr == nil {
+		info.BusName = t.busName()
 	}
-	err = menu.ExportDbusmenu(conn, menuPath, instance)
+	problems = errors.Join(nameErr, regErr)
+	if problems != nil {
+		logger().Warn("systray started with problems", "err", problems)
+	}
+	info.Err = problems
+	tr.ready(info)
+	return problems, nil
+}
+
+// errQuit is returned by export when the tray quits while it's being exported
+var errQuit = errors.New("tray has quit")
+
+// export connects to the session bus and exports the tray objects with the current tray state.
+// The failed name request is not fatal, it's returned as nameErr.
+func (t *tray) export(quitChan <-chan struct{}) (conn *dbus.Conn, nameErr, err error) {
+	conn, owned, err := t.connect()
 	if err != nil {
-		log.Printf("systray error: failed to export status notifier menu: %v\n", err)
+		return nil, nil, fmt.Errorf("%w: %w", ErrNoSessionBus, err)
+	}
+	props, menuProps, nameErr, err := t.exportObjects(conn)
+	if err != nil {
+		if owned {
+			conn.Close()
+		}
+		return nil, nil, err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	select {
+	case <-quitChan:
+		// the tray has quit while it was being exported
+		if owned {
+			conn.Close()
+		}
+		return nil, nil, errQuit
+	default:
+	}
+	t.conn, t.ownConn = conn, owned
+	t.props = props
+	t.menuProps = menuProps
+	if t.stateGen != t.specGen {
+		t.replayState()
+	}
+	return conn, nameErr, nil
+}
+
+// replayState publishes the state set while the tray was being exported,
+// it is always called after t.lock.Lock().
+func (t *tray) replayState() {
+	if t.batchDepth > 0 {
+		t.pendingIcon, t.pendingTitle, t.pendingTooltip = true, true, true
+		t.pendingAttentionIcon, t.pendingStatus = true, true
 		return
 	}
+	err := errors.Join(t.applyIcon(), t.applyTitle(), t.applyTooltip(), t.applyAttentionIcon(), t.applyStatus())
+	if err != nil {
+		logger().Warn("failed to replay tray state", errorAttrs(err)...)
+	}
+}
 
-	name := fmt.Sprintf("org.kde.StatusNotifierItem-%d-1", os.Getpid()) // register id 1 for this process
-	_, err = conn.RequestName(name, dbus.NameFlagDoNotQueue)
+// exportObjects exports the notifier item, the menu, their properties and introspection and requests the bus name.
+func (t *tray) exportObjects(conn *dbus.Conn) (props, menuProps *prop.Properties, nameErr, err error) {
+	path, menuPath := dbus.ObjectPath(t.path), dbus.ObjectPath(t.menuPath)
+	err = notifier.ExportStatusNotifierItem(conn, path, &notifierItem{owner: t.owner})
 	if err != nil {
-		log.Printf("systray error: failed to request name: %s\n", err)
-		// it's not critical error: continue
+		return nil, nil, nil, fmt.Errorf("failed to export status notifier item: %w", err)
 	}
-	props, err := prop.Export(conn, path, instance.createPropSpec())
+	err = menu.ExportDbusmenu(conn, menuPath, t)
 	if err != nil {
-		log.Printf("systray error: failed to export notifier item properties to bus: %s\n", err)
-		return
+		return nil, nil, nil, fmt.Errorf("failed to export status notifier menu: %w", err)
 	}
-	menuProps, err := prop.Export(conn, menuPath, createMenuPropSpec())
+
+	name := t.busName()
+	reply, err := conn.RequestName(name, dbus.NameFlagDoNotQueue)
 	if err != nil {
-		log.Printf("systray error: failed to export notifier menu properties to bus: %s\n", err)
-		return
+		nameErr = fmt.Errorf("failed to request name: %w", err)
+	} else if reply != dbus.RequestNameReplyPrimaryOwner && reply != dbus.RequestNameReplyAlreadyOwner {
+		nameErr = fmt.Errorf("%w: %s", ErrNameTaken, name)
+	}
+	props, err = prop.Export(conn, path, t.createPropSpec())
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to export notifier item properties to bus: %w", err)
+	}
+	menuProps, err = prop.Export(conn, menuPath, t.createMenuPropSpec())
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to export notifier menu properties to bus: %w", err)
 	}
 
 	node := introspect.Node{
-		Name: path,
+		Name: t.path,
 		Interfaces: []introspect.Interface{
 			introspect.IntrospectData,
 			prop.IntrospectData,
@@ -210,11 +650,10 @@ func nativeStart() {
 	err = conn.Export(introspect.NewIntrospectable(&node), path,
 		"org.freedesktop.DBus.Introspectable")
 	if err != nil {
-		log.Printf("systray error: failed to export node introspection: %s\n", err)
-		return
+		return nil, nil, nil, fmt.Errorf("failed to export node introspection: %w", err)
 	}
 	menuNode := introspect.Node{
-		Name: menuPath,
+		Name: t.menuPath,
 		Interfaces: []introspect.Interface{
 			introspect.IntrospectData,
 			prop.IntrospectData,
@@ -224,42 +663,221 @@ func nativeStart() {
 	err = conn.Export(introspect.NewIntrospectable(&menuNode), menuPath,
 		"org.freedesktop.DBus.Introspectable")
 	if err != nil {
-		log.Printf("systray error: failed to export menu node introspection: %s\n", err)
-		return
+		return nil, nil, nil, fmt.Errorf("failed to export menu node introspection: %w", err)
 	}
+	return props, menuProps, nameErr, nil
+}
 
-	instance.lock.Lock()
-	instance.conn = conn
-	instance.props = props
-	instance.menuProps = menuProps
-	instance.lock.Unlock()
+// supervise waits for the connection loss and reconnects the tray until quitChan is closed.
+// When the reconnection is disabled or the connection is set by WithConn the tray quits with ErrConnectionLost.
+func (tr *Tray) supervise(conn *dbus.Conn, quitChan <-chan struct{}) {
+	t := tr.native
+	defer t.workers.Done()
+	for {
+		select {
+		case <-quitChan:
+			return
+		case <-conn.Context().Done():
+		}
+		t.lock.Lock()
+		if t.conn != conn {
+			// the connection is closed by nativeEnd
+			t.lock.Unlock()
+			return
+		}
+		t.conn, t.props, t.menuProps = nil, nil, nil
+		tr.registration.change(StateUnregistered, ErrConnectionLost)
+		minDelay, _ := reconnectDelay()
+		// the connection set by WithConn can't be reconnected
+		canReconnect := minDelay > 0 && t.ownConn
+		if !canReconnect {
+			t.connErr = ErrConnectionLost
+		}
+		t.lock.Unlock()
+		if !canReconnect {
+			logger().Error("connection to the session bus is lost", "path", t.path)
+			tr.Quit()
+			return
+		}
+		logger().Warn("connection to the session bus is lost, reconnecting", "path", t.path)
+		if conn = t.reconnect(quitChan); conn == nil {
+			return
+		}
+	}
+}
 
-	go stayRegistered()
+// reconnect exports the tray on a new connection and registers it, the attempts are repeated with
+// the growing delay until they succeed or quitChan is closed. It returns nil when the tray quits.
+func (t *tray) reconnect(quitChan <-chan struct{}) *dbus.Conn {
+	delay, maxDelay := reconnectDelay()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-quitChan:
+			return nil
+		case <-timer.C:
+		}
+		conn, nameErr, err := t.export(quitChan)
+		if errors.Is(err, errQuit) {
+			return nil
+		}
+		if err != nil {
+			logger().Warn("failed to reconnect", "attempt", attempt, "err", err)
+			delay = min(delay*2, maxDelay)
+			timer.Reset(delay)
+			continue
+		}
+		logger().Info("reconnected to the session bus", "attempt", attempt, "path", t.path)
+		if nameErr != nil {
+			logger().Warn("failed to request name", "err", nameErr)
+		}
+		if err := t.register(conn); err != nil {
+			logger().Warn("failed to register", "method", registerMethod, "err", err)
+		}
+		t.workers.Add(1)
+		go t.stayRegistered(conn, quitChan)
+		return conn
+	}
+}
+
+// propertiesSetMethod is the D-Bus method setting the exported properties
+const propertiesSetMethod = "org.freedesktop.DBus.Properties.Set"
+
+// callError returns err of the failed D-Bus method call or signal of the tray object
+func (t *tray) callError(method string, err error) error {
+	return &callError{method: method, path: t.path, err: err}
 }
 
-func register() bool {
-	obj := instance.conn.Object("org.kde.StatusNotifierWatcher", "/StatusNotifierWatcher")
-	call := obj.Call("org.kde.StatusNotifierWatcher.RegisterStatusNotifierItem", 0, path)
+// registerMethod is the StatusNotifierWatcher method to register the tray
+const registerMethod = "org.kde.StatusNotifierWatcher.RegisterStatusNotifierItem"
+
+// register registers the tray in the StatusNotifierWatcher.
+// The returned error wraps ErrNoWatcher if there is no watcher on the bus.
+func (t *tray) register(conn *dbus.Conn) error {
+	obj := conn.Object("org.kde.StatusNotifierWatcher", "/StatusNotifierWatcher")
+	call := obj.Call(registerMethod, 0, t.path)
 	if call.Err != nil {
-		log.Printf("systray error: failed to register: %v\n", call.Err)
-		return false
+		err := fmt.Errorf("failed to register: %w", call.Err)
+		state := StateUnregistered
+		if isServiceUnknown(call.Err) {
+			err = fmt.Errorf("%w: %w", ErrNoWatcher, err)
+			state = StateNoWatcher
+		}
+		t.setRegistration(conn, state, err)
+		return err
 	}
 
-	return true
+	logger().Debug("registered", "method", registerMethod, "path", t.path)
+	state, err := t.hostState(conn)
+	if err != nil {
+		logger().Debug("failed to check the host", "path", t.path, "err", err)
+		return nil
+	}
+	t.setRegistration(conn, state, nil)
+	return nil
+}
+
+// setRegistration sets the registration state found on conn, err is the reason of the change.
+// The state is dropped when the tray has quit or it has been reconnected meanwhile, as it's outdated then.
+func (t *tray) setRegistration(conn *dbus.Conn, state RegistrationState, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	select {
+	case <-t.quit:
+		return
+	default:
+	}
+	if t.conn != conn {
+		return
+	}
+	t.owner.registration.change(state, err)
+}
+
+// isServiceUnknown checks if the call failed because there is no such service on the bus
+func isServiceUnknown(err error) bool {
+	var dbusErr dbus.Error
+	return errors.As(err, &dbusErr) && dbusErr.Name == "org.freedesktop.DBus.Error.ServiceUnknown"
+}
+
+// hostState returns StateNoHost if the watcher reports that there is no StatusNotifierHost
+// and StateRegistered if there is one. The error is returned when the watcher can't tell it.
+func (t *tray) hostState(conn *dbus.Conn) (RegistrationState, error) {
+	obj := conn.Object("org.kde.StatusNotifierWatcher", "/StatusNotifierWatcher")
+	v, err := obj.GetProperty("org.kde.StatusNotifierWatcher.IsStatusNotifierHostRegistered")
+	if err != nil {
+		return StateUnregistered, err
+	}
+	registered, ok := v.Value().(bool)
+	if !ok {
+		return StateUnregistered, fmt.Errorf("unexpected host state %v", v)
+	}
+	if !registered {
+		return StateNoHost, nil
+	}
+	return StateRegistered, nil
+}
+
+// registrationCheckInterval is the default interval of verifying the tray registration in the watcher
+const registrationCheckInterval = 10 * time.Second
+
+// verifyRegistration checks that the watcher still has the tray registered and registers it again otherwise
+func (t *tray) verifyRegistration(conn *dbus.Conn) {
+	obj := conn.Object("org.kde.StatusNotifierWatcher", "/StatusNotifierWatcher")
+	v, err := obj.GetProperty("org.kde.StatusNotifierWatcher.RegisteredStatusNotifierItems")
+	if err != nil {
+		if isServiceUnknown(err) {
+			t.setRegistration(conn, StateNoWatcher, fmt.Errorf("%w: %w", ErrNoWatcher, err))
+		}
+		// otherwise the watcher doesn't provide the items, so the registration can't be verified
+		return
+	}
+	items, _ := v.Value().([]string)
+	if !slices.ContainsFunc(items, t.isService(conn)) {
+		logger().Warn("tray is missing in the watcher, registering again", "path", t.path)
+		if err := t.register(conn); err != nil {
+			logger().Warn("failed to register", "method", registerMethod, "err", err)
+		}
+		return
+	}
+	if state, err := t.hostState(conn); err == nil {
+		t.setRegistration(conn, state, nil)
+	}
 }
 
-func stayRegistered() {
-	register()
+// isService returns the function which checks if the watcher item is this tray.
+// The watchers identify the items registered by the object path as the sender name followed by the path.
+func (t *tray) isService(conn *dbus.Conn) func(string) bool {
+	var sender string
+	if names := conn.Names(); len(names) > 0 {
+		sender = names[0]
+	}
+	name := t.busName()
+	return func(item string) bool {
+		switch item {
+		case sender + t.path, sender, name + t.path, name:
+			return true
+		}
+		return false
+	}
+}
 
-	conn := instance.conn
-	if err := conn.AddMatchSignal(
+func (t *tray) stayRegistered(conn *dbus.Conn, quitChan <-chan struct{}) {
+	defer t.workers.Done()
+	match := []dbus.MatchOption{
 		dbus.WithMatchObjectPath("/org/freedesktop/DBus"),
 		dbus.WithMatchInterface("org.freedesktop.DBus"),
 		dbus.WithMatchSender("org.freedesktop.DBus"),
 		dbus.WithMatchMember("NameOwnerChanged"),
 		dbus.WithMatchArg(0, "org.kde.StatusNotifierWatcher"),
-	); err != nil {
-		log.Printf("systray error: failed to register signal matching: %v\n", err)
+	}
+	if err := conn.AddMatchSignal(match...); err != nil {
+		select {
+		case <-quitChan:
+			return // the connection is closed on quit
+		default:
+		}
+		logger().Error("failed to watch StatusNotifierWatcher", "method", "org.freedesktop.DBus.AddMatch", "err", err)
 		// If we can't monitor signals, there is no point in
 		// us being here. we're either registered or not (per
 		// above) and will roll the dice from here...
@@ -268,6 +886,19 @@ func stayRegistered() {
 
 	sc := make(chan *dbus.Signal, 10)
 	conn.Signal(sc)
+	// the connection may outlive the tray when it's set by WithConn
+	defer func() {
+		conn.RemoveSignal(sc)
+		_ = conn.RemoveMatchSignal(match...)
+	}()
+	if t.owner.registration.get() == StateNoWatcher {
+		// the watcher may have appeared before its signals are watched
+		t.verifyRegistration(conn)
+	}
+	t.lock.Lock()
+	ticker := time.NewTicker(t.checkInterval)
+	t.lock.Unlock()
+	defer ticker.Stop()
 
 	for {
 		select {
@@ -280,41 +911,138 @@ func stayRegistered() {
 
 			// sig.Body has the args, which are [name old_owner new_owner]
 			if s, ok := sig.Body[2].(string); ok && s != "" {
-				register()
+				if err := t.register(conn); err != nil {
+					logger().Warn("failed to register", "method", registerMethod, "err", err)
+				}
+			} else if ok {
+				t.setRegistration(conn, StateNoWatcher, ErrNoWatcher)
 			}
+		case <-ticker.C:
+			t.verifyRegistration(conn)
 		case <-quitChan:
 			return
 		}
 	}
 }
 
+// notifierItem handles the org.kde.StatusNotifierItem methods
+type notifierItem struct {
+	notifier.UnimplementedStatusNotifierItem
+	owner *Tray
+}
+
+// Activate is org.kde.StatusNotifierItem.Activate method.
+// When nobody listens to the events the call fails, so the host falls back to showing the menu.
+func (n *notifierItem) Activate(x int32, y int32) *dbus.Error {
+	if !n.owner.events.listened() {
+		return &dbus.ErrMsgUnknownMethod
+	}
+	n.owner.events.publish(Event{Type: EventActivate, X: int(x), Y: int(y)})
+	return nil
+}
+
+// SecondaryActivate is org.kde.StatusNotifierItem.SecondaryActivate method.
+func (n *notifierItem) SecondaryActivate(x int32, y int32) *dbus.Error {
+	if !n.owner.events.listened() {
+		return &dbus.ErrMsgUnknownMethod
+	}
+	n.owner.events.publish(Event{Type: EventSecondaryActivate, X: int(x), Y: int(y)})
+	return nil
+}
+
+// Scroll is org.kde.StatusNotifierItem.Scroll method.
+func (n *notifierItem) Scroll(delta int32, orientation string) *dbus.Error {
+	n.owner.events.publish(Event{Type: EventScroll, Delta: int(delta), Orientation: orientation})
+	return nil
+}
+
 // tray is a basic type that handles the dbus functionality
 type tray struct {
-	// the DBus connection that we will use
-	conn *dbus.Conn
+	// owner is the Tray served by this DBus tray server
+	owner *Tray
+	// index is used in the bus name of the tray, path and menuPath are its object paths
+	index          uint32
+	path, menuPath string
+
+	// the DBus connection that we will use, ownConn reports whether it's closed by the tray
+	conn    *dbus.Conn
+	ownConn bool
+	// extConn is the connection set by WithConn, busAddress is the address set by WithBusAddress
+	extConn    *dbus.Conn
+	busAddress string
+	// quit is closed to signal quitting the internal main loop
+	quit chan struct{}
+	// connErr is the reason the tray has quit by itself
+	connErr error
 
-	// icon PixMap for the main systray icon
-	iconData PX
+	// icon PixMaps for the main systray icon, one per size
+	iconData []PX
+	// attentionIconData is shown instead of iconData while the status is StatusNeedsAttention
+	attentionIconData []PX
+	status            Status
+	// badge is the count drawn on the icon pixmaps when it's positive
+	badge      int
+	badgeStyle BadgeStyle
+	// progress is drawn on the icon pixmaps while showProgress is set, its updates are published
+	// not more often than progressInterval after progressPublished, progressTimer publishes the deferred one
+	progress          float64
+	showProgress      bool
+	progressStyle     ProgressStyle
+	progressPublished time.Time
+	progressTimer     *time.Timer
 	// title and tooltip state
 	title, tooltipTitle, id string
+	// stateGen counts the icon, title and tooltip changes, specGen is its value when
+	// the exported properties were created, so the changes made during export are replayed
+	stateGen, specGen uint64
+
+	// batchDepth is the number of active Batch calls, while it's positive
+	// all changes are deferred and marked as pending
+	batchDepth                                             int
+	pendingIcon, pendingTitle, pendingTooltip, pendingMenu bool
+	pendingAttentionIcon, pendingStatus                    bool
 
 	lock             sync.Mutex
 	menu             *menuLayout
 	menuLock         sync.RWMutex
 	props, menuProps *prop.Properties
 	menuVersion      uint32
+	// menuSnapshot is the menu taken when the batch has begun, it's served to the host
+	// instead of the menu changed by the batch till the batch is committed
+	menuSnapshot *menuLayout
+	// menuChanged is set by the menu changes not published yet, so the refresher
+	// doesn't publish the batch commit once again
+	menuChanged bool
+	// refresher schedules the menu layout updates
+	refresher *refresher
+	// checkInterval is the interval of verifying the tray registration in the watcher
+	checkInterval time.Duration
+	// workers counts the goroutines keeping the tray registered and connected,
+	// nativeEnd waits for them, so they don't change the state of the finished run
+	workers sync.WaitGroup
+}
+
+// quitChan returns the channel to be closed on quit
+func (t *tray) quitChan() <-chan struct{} {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.quit
 }
 
 func (t *tray) createPropSpec() map[string]map[string]*prop.Prop {
 	t.lock.Lock()
 	defer t.lock.Unlock()
+	t.specGen = t.stateGen
 	if t.id == "" {
 		t.id = fmt.Sprintf("systray_%d", os.Getpid())
+		if t.index > 1 {
+			t.id = fmt.Sprintf("systray_%d_%d", os.Getpid(), t.index)
+		}
 	}
 	return map[string]map[string]*prop.Prop{
 		"org.kde.StatusNotifierItem": {
 			"Status": {
-				Value:    "Active", // Passive, Active or NeedsAttention
+				Value:    t.status.String(),
 				Writable: false,
 				Emit:     prop.EmitTrue,
 				Callback: nil,
@@ -344,11 +1072,17 @@ func (t *tray) createPropSpec() map[string]map[string]*prop.Prop {
 				Callback: nil,
 			},
 			"IconPixmap": {
-				Value:    []PX{t.iconData},
+				Value:    t.decoratedIcon(),
 				Writable: true,
 				Emit:     prop.EmitTrue,
 				Callback: nil,
 			},
+			"AttentionIconPixmap": {
+				Value:    published(t.attentionIconData),
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
 			"IconThemePath": {
 				Value:    "",
 				Writable: false,
@@ -362,7 +1096,7 @@ func (t *tray) createPropSpec() map[string]map[string]*prop.Prop {
 				Callback: nil,
 			},
 			"Menu": {
-				Value:    dbus.ObjectPath(menuPath),
+				Value:    dbus.ObjectPath(t.menuPath),
 				Writable: true,
 				Emit:     prop.EmitTrue,
 				Callback: nil,
@@ -391,17 +1125,49 @@ type tooltip = struct {
 	V3 string // description
 }
 
-func convertToPixels(data []byte) PX {
+// convertToPixels decodes the PNG, JPEG, GIF, BMP or ICO icon, the returned error wraps ErrBadIcon.
+// Every image of the ICO file becomes a pixmap, so the host can choose the best size.
+// Empty data are converted to no pixmaps.
+func convertToPixels(data []byte) ([]PX, error) {
 	if len(data) == 0 {
-		return PX{}
+		return nil, nil
 	}
 
-	img, _, err := image.Decode(bytes.NewReader(data))
+	var images []image.Image
+	var err error
+	if bytes.HasPrefix(data, []byte(icoHeader)) {
+		images, err = decodeICOFrames(data)
+	} else {
+		var img image.Image
+		img, _, err = image.Decode(bytes.NewReader(data))
+		images = []image.Image{img}
+	}
 	if err != nil {
-		log.Printf("Failed to read icon format %v", err)
-		return PX{}
+		return nil, fmt.Errorf("%w: failed to read icon format: %w", ErrBadIcon, err)
+	}
+
+	pixmaps := make([]PX, len(images))
+	for i, img := range images {
+		pixmaps[i] = pixmap(img)
+	}
+	return pixmaps, nil
+}
+
+// published returns the copy of the pixmaps for the exported property. The property value is
+// updated in place, so it must not share the elements with the tray state or the icon cache.
+func published(pixmaps []PX) []PX {
+	return append([]PX{}, pixmaps...)
+}
+
+// pixmapsForImage converts the image to the icon pixmaps, nil image is converted to no pixmaps
+func pixmapsForImage(img image.Image) []PX {
+	if img == nil {
+		return nil
 	}
+	return []PX{pixmap(img)}
+}
 
+func pixmap(img image.Image) PX {
 	return PX{
 		W:   img.Bounds().Dx(),
 		H:   img.Bounds().Dy(),
@@ -409,19 +1175,93 @@ func convertToPixels(data []byte) PX {
 	}
 }
 
+func encodeIcon(img image.Image) ([]byte, error) {
+	return encodePNG(img)
+}
+
+// iconFrame is the predecoded frame of the icon animation
+type iconFrame = []PX
+
+// decodeFrame decodes the animation frame, the frames aren't cached as they are decoded once
+func decodeFrame(data []byte) (iconFrame, error) {
+	return convertToPixels(data)
+}
+
+func imageFrame(img image.Image) (iconFrame, error) {
+	return pixmapsForImage(img), nil
+}
+
+func (tr *Tray) showFrame(frame iconFrame) error {
+	return tr.native.setIconData(frame)
+}
+
+// passive checks if the tray status is StatusPassive
+func (tr *Tray) passive() bool {
+	t := tr.native
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.status == StatusPassive
+}
+
+// argbForImage converts the image to the non-premultiplied ARGB32 pixels in network byte order
+// as StatusNotifierItem expects.
 func argbForImage(img image.Image) []byte {
-	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
 	data := make([]byte, w*h*4)
 	i := 0
-	for y := 0; y < h; y++ {
-		for x := 0; x < w; x++ {
-			r, g, b, a := img.At(x, y).RGBA()
-			data[i] = byte(a)
-			data[i+1] = byte(r)
-			data[i+2] = byte(g)
-			data[i+3] = byte(b)
-			i += 4
+	switch img := img.(type) {
+	case *image.NRGBA:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := img.Pix[img.PixOffset(b.Min.X, y):][:w*4]
+			for j := 0; j < len(row); j += 4 {
+				data[i], data[i+1], data[i+2], data[i+3] = row[j+3], row[j], row[j+1], row[j+2]
+				i += 4
+			}
+		}
+	case *image.RGBA:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := img.Pix[img.PixOffset(b.Min.X, y):][:w*4]
+			for j := 0; j < len(row); j += 4 {
+				if a := uint32(row[j+3]); a != 0 {
+					// the same rounding as color.NRGBAModel does
+					data[i] = byte(a)
+					data[i+1] = byte(uint32(row[j]) * 0xffff / a >> 8)
+					data[i+2] = byte(uint32(row[j+1]) * 0xffff / a >> 8)
+					data[i+3] = byte(uint32(row[j+2]) * 0xffff / a >> 8)
+				}
+				i += 4
+			}
+		}
+	case *image.Paletted:
+		palette := make([][4]byte, len(img.Palette))
+		for j, c := range img.Palette {
+			palette[j] = argb(c)
+		}
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := img.Pix[img.PixOffset(b.Min.X, y):][:w]
+			for _, index := range row {
+				// the index out of the palette is left transparent
+				if int(index) < len(palette) {
+					copy(data[i:], palette[index][:])
+				}
+				i += 4
+			}
+		}
+	default:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := argb(img.At(x, y))
+				copy(data[i:], c[:])
+				i += 4
+			}
 		}
 	}
 	return data
 }
+
+// argb converts the color to the non-premultiplied ARGB32 pixel
+func argb(c color.Color) [4]byte {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return [4]byte{n.A, n.R, n.G, n.B}
+}
@@ -0,0 +1,1859 @@
+//go:build (linux || freebsd || openbsd || netbsd) && !android
+
+package systray
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+func TestMenuTree(t *testing.T) {
+	ResetMenu()
+	defer ResetMenu()
+
+	top := AddMenuItem("Top", "top tooltip")
+	AddSeparator()
+	advanced := AddMenuItem("Advanced", "")
+	first := advanced.AddSubMenuItem("First", "")
+	second := advanced.AddSubMenuItemCheckbox("Second", "", true)
+	nested := first.AddSubMenuItem("Nested", "")
+
+	if top.Title() != "Top" || top.Tooltip() != "top tooltip" {
+		t.Errorf("unexpected title/tooltip: %q/%q", top.Title(), top.Tooltip())
+	}
+	if nested.Parent() != first || first.Parent() != advanced || advanced.Parent() != nil {
+		t.Error("unexpected parents")
+	}
+	if !slices.Equal(advanced.Children(), []*MenuItem{first, second}) {
+		t.Errorf("unexpected children: %v", advanced.Children())
+	}
+	if got := slices.Collect(Items()); !slices.Equal(got, []*MenuItem{top, advanced, first, nested, second}) {
+		t.Errorf("unexpected items order: %v", got)
+	}
+	if FindItem(nested.ID()) != nested {
+		t.Error("FindItem can't find nested item")
+	}
+
+	second.Hide()
+	if second.Visible() {
+		t.Error("hidden item is visible")
+	}
+	defaultTray.native.menuLock.Lock()
+	layout, ok := defaultTray.native.findLayout(int32(second.ID()))
+	visible := layout.V1["visible"].Value()
+	defaultTray.native.menuLock.Unlock()
+	if !ok || visible != false {
+		t.Errorf("layout visibility is out of sync: %v", visible)
+	}
+	second.Show()
+	if !second.Visible() {
+		t.Error("shown item is not visible")
+	}
+
+	first.Remove()
+	if FindItem(first.ID()) != nil || FindItem(nested.ID()) != nil {
+		t.Error("removed items are still in the menu")
+	}
+	if got := slices.Collect(Items()); !slices.Equal(got, []*MenuItem{top, advanced, second}) {
+		t.Errorf("unexpected items after remove: %v", got)
+	}
+	first.SetTitle("Removed")
+	defaultTray.native.menuLock.Lock()
+	_, ok = defaultTray.native.findLayout(int32(first.ID()))
+	defaultTray.native.menuLock.Unlock()
+	if ok {
+		t.Error("update of removed item restored its layout")
+	}
+}
+
+func TestRefresherCoalescesRequests(t *testing.T) {
+	SetRefreshLatency(time.Millisecond, 10*time.Millisecond)
+	defer SetRefreshLatency(DefaultRefreshMinLatency, DefaultRefreshMaxLatency)
+
+	r := newRefresher()
+	var flushes atomic.Int32
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.run(func() { flushes.Add(1) }, stop)
+
+	const goroutines, requests = 64, 1000
+	var wg sync.WaitGroup
+	for range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range requests {
+				r.request()
+			}
+		}()
+	}
+	wg.Wait()
+
+	waitFor(t, func() bool { return !r.dirty.Load() && flushes.Load() > 0 })
+	if n := flushes.Load(); n >= goroutines*requests {
+		t.Errorf("requests are not coalesced: %d flushes", n)
+	}
+
+	// the last change must never be lost
+	before := flushes.Load()
+	r.request()
+	waitFor(t, func() bool { return flushes.Load() > before })
+}
+
+func TestRefreshDoesNotDeadlock(t *testing.T) {
+	ResetMenu()
+	defer ResetMenu()
+	SetRefreshLatency(0, time.Millisecond)
+	defer SetRefreshLatency(DefaultRefreshMinLatency, DefaultRefreshMaxLatency)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	// the flush competes for defaultTray.native.menuLock the same way as doRefresh does
+	go defaultTray.native.refresher.run(func() {
+		defaultTray.native.menuLock.Lock()
+		defaultTray.native.menuVersion++
+		defaultTray.native.menuLock.Unlock()
+	}, stop)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for i := range 32 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				parent := AddMenuItem(fmt.Sprint("Parent ", i), "")
+				for j := range 50 {
+					Batch(func() {
+						child := parent.AddSubMenuItemCheckbox(fmt.Sprint("Child ", j), "", j%2 == 0)
+						child.Check()
+						child.Hide()
+						child.Show()
+						child.SetTitle("Changed")
+					})
+					parent.AddSeparator()
+				}
+				parent.Remove()
+			}()
+		}
+		wg.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("menu updates are deadlocked")
+	}
+}
+
+func TestBatchPublishesOneLayoutRevision(t *testing.T) {
+	watcher := startFakeWatcher(t)
+	SetRefreshLatency(time.Millisecond, 5*time.Millisecond)
+	defer SetRefreshLatency(DefaultRefreshMinLatency, DefaultRefreshMaxLatency)
+	tr, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runTray(t, tr, func() {
+		defer tr.Quit()
+		path := dbus.ObjectPath(tr.native.menuPath)
+		if err := watcher.conn.AddMatchSignal(dbus.WithMatchObjectPath(path), dbus.WithMatchMember("LayoutUpdated")); err != nil {
+			t.Fatal(err)
+		}
+		signals := make(chan *dbus.Signal, 10)
+		watcher.conn.Signal(signals)
+		defer watcher.conn.RemoveSignal(signals)
+		tr.native.lock.Lock()
+		obj := watcher.conn.Object(tr.native.conn.Names()[0], path)
+		tr.native.lock.Unlock()
+		// layout returns the revision and the number of items of the layout served to the host
+		layout := func() (uint32, int) {
+			var revision uint32
+			var layout menuLayout
+			err := obj.Call("com.canonical.dbusmenu.GetLayout", 0, int32(0), int32(-1), []string{}).Store(&revision, &layout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return revision, len(layout.V2)
+		}
+		before, _ := layout()
+
+		tr.Batch(func() {
+			for i := range 5 {
+				// the refresher fires in the middle of the batch and after it
+				time.Sleep(10 * time.Millisecond)
+				item := tr.AddMenuItem(fmt.Sprint("Item ", i), "")
+				// the host gets the menu as it was before the batch
+				if revision, n := layout(); revision != before || n != 0 {
+					t.Errorf("the half-built menu of %d items is served in the revision %d", n, revision)
+				}
+				if props, _ := tr.native.GetGroupProperties([]int32{int32(item.ID())}, nil); len(props) != 0 {
+					t.Errorf("the properties of the item added by the batch are served: %v", props)
+				}
+			}
+		})
+		if revision, n := layout(); revision != before+1 || n != 5 {
+			t.Errorf("the menu of %d items is served in the revision %d after the batch", n, revision)
+		}
+		var got []uint32
+		timeout := time.After(100 * time.Millisecond)
+		for {
+			select {
+			case s := <-signals:
+				if s.Path == path {
+					got = append(got, s.Body[0].(uint32))
+				}
+			case <-timeout:
+				if len(got) != 1 {
+					t.Errorf("the batch is published in the layout revisions %v", got)
+				}
+				return
+			}
+		}
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// runChecked runs the tray by run and calls check in the test goroutine once the tray is ready.
+// onReady runs in its own goroutine, where t.Fatal doesn't stop the test, so the checks are
+// done by check, and check has to make the tray quit even when it stops the test.
+// It returns the error returned by run.
+func runChecked(t *testing.T, run func(onReady func()) error, check func()) (err error) {
+	t.Helper()
+	ready := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- run(func() { close(ready) })
+	}()
+	defer func() { err = <-done }()
+	select {
+	case <-ready:
+		check()
+	case err := <-done:
+		// the tray has failed to start
+		done <- err
+	}
+	return nil
+}
+
+// runTray runs the tray by RunE and calls check like runChecked does
+func runTray(t *testing.T, tr *Tray, check func()) error {
+	t.Helper()
+	return runChecked(t, func(onReady func()) error { return tr.RunE(onReady, nil) }, check)
+}
+
+// waitFor waits until cond becomes true or fails the test after a while
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition is not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestOnClickDeliversEveryClickInOrder(t *testing.T) {
+	ResetMenu()
+	defer ResetMenu()
+
+	item := AddMenuItem("Click me", "")
+	const clicks = 100
+	events := make(chan ClickEvent, clicks)
+	item.OnClick(func(e ClickEvent) {
+		time.Sleep(time.Microsecond) // a busy handler must not lose clicks
+		events <- e
+	})
+	for i := range clicks {
+		defaultTray.native.Event(int32(item.ID()), "clicked", dbus.MakeVariant(fmt.Sprint(i)), uint32(i))
+	}
+	for i := range clicks {
+		select {
+		case e := <-events:
+			if e.Item != item || e.Timestamp != uint32(i) || e.Data != fmt.Sprint(i) {
+				t.Fatalf("unexpected event #%d: %+v", i, e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("click #%d is lost", i)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	ResetMenu()
+	defer ResetMenu()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := Events(ctx, WithEventBuffer(2), WithOverflowPolicy(DropOldest))
+	item := AddMenuItem("Item", "")
+	notifier := notifierItem{owner: defaultTray}
+	notifier.Scroll(3, "vertical")
+	defaultTray.native.Event(int32(item.ID()), "clicked", dbus.MakeVariant(""), 42)
+	defaultTray.native.Event(0, "opened", dbus.MakeVariant(""), 43)
+
+	// the scroll event is dropped to free the room for the menu event,
+	// so the drop is reported by the click delivered right after it
+	e := <-ch
+	if e.Type != EventClick || e.Item != item || e.ItemID != item.ID() || e.Timestamp != 42 || e.Dropped != 1 {
+		t.Errorf("unexpected click event: %+v", e)
+	}
+	e = <-ch
+	if e.Type != EventMenuOpened || e.Item != nil || e.Dropped != 0 {
+		t.Errorf("unexpected menu event: %+v", e)
+	}
+
+	// the drops are summed up when the event reporting them is dropped too
+	single := Events(ctx, WithEventBuffer(1), WithOverflowPolicy(DropOldest))
+	for i := range 3 {
+		notifier.Scroll(int32(i), "vertical")
+	}
+	for len(ch) > 0 {
+		<-ch
+	}
+	if e = <-single; e.Delta != 2 || e.Dropped != 2 {
+		t.Errorf("unexpected scroll event: %+v", e)
+	}
+	if err := notifier.Activate(1, 2); err != nil {
+		t.Errorf("Activate failed: %v", err)
+	}
+	if e = <-ch; e.Type != EventActivate || e.X != 1 || e.Y != 2 {
+		t.Errorf("unexpected activate event: %+v", e)
+	}
+
+	cancel()
+	for range ch {
+	}
+	for range single {
+	}
+	if err := notifier.Activate(1, 2); err == nil {
+		t.Error("Activate must fail without events listeners")
+	}
+}
+
+func TestMenuItemConcurrentAccess(t *testing.T) {
+	ResetMenu()
+	defer ResetMenu()
+
+	item := AddMenuItemCheckbox("Item", "", false)
+	const goroutines, toggles = 16, 101
+	var wg sync.WaitGroup
+	for i := range goroutines {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for range toggles {
+				item.Toggle()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := range toggles {
+				item.SetTitle(fmt.Sprint(i, j))
+				item.SetTooltip(item.Title())
+				_ = item.Checked()
+				_ = item.String()
+				defaultTray.native.GetLayout(0, -1, nil)
+			}
+		}()
+	}
+	wg.Wait()
+	// every goroutine makes an odd number of toggles
+	if item.Checked() != (goroutines%2 == 1) {
+		t.Errorf("toggles are lost: checked = %v", item.Checked())
+	}
+	if !item.CompareAndSwapChecked(item.Checked(), true) || item.CompareAndSwapChecked(false, true) || !item.Checked() {
+		t.Error("CompareAndSwapChecked works wrong")
+	}
+}
+
+func TestAutoToggleAndBind(t *testing.T) {
+	ResetMenu()
+	defer ResetMenu()
+
+	item := AddMenuItemCheckbox("Item", "", false)
+	item.SetAutoToggle(true)
+	changes := make(chan bool, 10)
+	item.OnCheckedChanged(func(checked bool) { changes <- checked })
+	var value atomic.Bool
+	item.Bind(&value)
+
+	defaultTray.native.Event(int32(item.ID()), "clicked", dbus.MakeVariant(""), 0)
+	if !item.Checked() || !value.Load() {
+		t.Errorf("click is not applied: item %v, variable %v", item.Checked(), value.Load())
+	}
+	if checked := <-changes; !checked {
+		t.Error("unexpected change notification")
+	}
+
+	value.Store(false)
+	waitFor(t, func() bool { return !item.Checked() })
+	if checked := <-changes; checked {
+		t.Error("unexpected change notification")
+	}
+
+	// the variable and the handler get the check marks of the concurrent toggles in order
+	var lock sync.Mutex
+	var notified []bool
+	item.OnCheckedChanged(func(checked bool) {
+		lock.Lock()
+		defer lock.Unlock()
+		notified = append(notified, checked)
+	})
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				item.Toggle()
+			}
+		}()
+	}
+	wg.Wait()
+	if item.Checked() != value.Load() {
+		t.Errorf("the variable is out of sync: item %v, variable %v", item.Checked(), value.Load())
+	}
+	waitFor(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(notified) == 8*1000
+	})
+	for i, checked := range notified {
+		if checked != (i%2 == 0) {
+			t.Fatalf("change #%d is notified out of order", i)
+		}
+	}
+	if last := notified[len(notified)-1]; last != item.Checked() {
+		t.Errorf("the last notification %v disagrees with the check mark", last)
+	}
+	item.OnCheckedChanged(nil)
+
+	item.Remove()
+	waitFor(t, func() bool { return item.binding.Load() == nil })
+	// the bound variables aren't polled without bindings
+	waitFor(t, func() bool {
+		bindings.lock.Lock()
+		defer bindings.lock.Unlock()
+		return !bindings.running
+	})
+}
+
+func TestSetIconEReportsBadIcon(t *testing.T) {
+	if err := SetIconE([]byte("not an image")); !errors.Is(err, ErrBadIcon) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := SetIconE(nil); err != nil {
+		t.Errorf("empty icon must clear the icon: %v", err)
+	}
+}
+
+func TestLoggerIsCached(t *testing.T) {
+	if logger() != logger() {
+		t.Error("the default logger is derived on every call")
+	}
+	// the logger follows the changed default logger
+	defer slog.SetDefault(slog.Default())
+	var buf bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	logger().Info("message")
+	if !strings.Contains(buf.String(), "module=systray") {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+
+	defer customLogger.Store(nil)
+	custom := slog.New(slog.DiscardHandler)
+	SetLogger(custom)
+	if logger() != custom {
+		t.Error("the logger set by SetLogger isn't used")
+	}
+}
+
+func TestFailedCallIsLogged(t *testing.T) {
+	defer customLogger.Store(nil)
+	var buf bytes.Buffer
+	SetLogger(slog.New(slog.NewTextHandler(&buf, nil)))
+	tr, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	callErr := tr.native.callError("org.kde.StatusNotifierItem.NewTitle", errors.New("failed to emit"))
+	logger().Error("failed to apply", errorAttrs(errors.Join(errors.New("other"), callErr))...)
+	want := fmt.Sprintf("method=org.kde.StatusNotifierItem.NewTitle path=%s", tr.native.path)
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+}
+
+// fakeWatcher is a minimal org.kde.StatusNotifierWatcher
+type fakeWatcher struct {
+	conn    *dbus.Conn
+	props   *prop.Properties
+	lock    sync.Mutex
+	items   []string
+	senders []dbus.Sender
+}
+
+func (w *fakeWatcher) RegisterStatusNotifierItem(sender dbus.Sender, service string) *dbus.Error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.items = append(w.items, string(sender)+service)
+	w.senders = append(w.senders, sender)
+	w.props.SetMust("org.kde.StatusNotifierWatcher", "RegisteredStatusNotifierItems", slices.Clone(w.items))
+	return nil
+}
+
+// forget drops all registered items like the restarted watcher does
+func (w *fakeWatcher) forget() {
+	w.props.SetMust("org.kde.StatusNotifierWatcher", "RegisteredStatusNotifierItems", []string{})
+}
+
+// setHost sets IsStatusNotifierHostRegistered property
+func (w *fakeWatcher) setHost(registered bool) {
+	w.props.SetMust("org.kde.StatusNotifierWatcher", "IsStatusNotifierHostRegistered", registered)
+}
+
+// property returns the property of the last registered item
+func (w *fakeWatcher) property(path dbus.ObjectPath, name string) (interface{}, error) {
+	w.lock.Lock()
+	sender := w.senders[len(w.senders)-1]
+	w.lock.Unlock()
+	v, err := w.conn.Object(string(sender), path).GetProperty(name)
+	return v.Value(), err
+}
+
+// registered returns the registered items
+func (w *fakeWatcher) registered() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return slices.Clone(w.items)
+}
+
+// startFakeWatcher exports the fake watcher on the session bus, the test is skipped when there is no session bus
+func startFakeWatcher(t *testing.T) *fakeWatcher {
+	t.Helper()
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		t.Skipf("no session bus: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	w := &fakeWatcher{conn: conn}
+	if err := conn.Export(w, "/StatusNotifierWatcher", "org.kde.StatusNotifierWatcher"); err != nil {
+		t.Fatal(err)
+	}
+	props, err := prop.Export(conn, "/StatusNotifierWatcher", prop.Map{
+		"org.kde.StatusNotifierWatcher": {
+			"RegisteredStatusNotifierItems":  {Value: []string{}, Emit: prop.EmitTrue},
+			"IsStatusNotifierHostRegistered": {Value: true, Emit: prop.EmitTrue},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.props = props
+	if reply, err := conn.RequestName("org.kde.StatusNotifierWatcher", dbus.NameFlagDoNotQueue); err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("can't own the watcher name: %v", err)
+	}
+	return w
+}
+
+func TestRunContext(t *testing.T) {
+	watcher := startFakeWatcher(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	err := runChecked(t, func(onReady func()) error { return RunContext(ctx, onReady) }, func() {
+		defer cancel()
+		waitFor(t, func() bool { return len(watcher.registered()) > 0 && Registered() })
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRunAgainAfterQuit(t *testing.T) {
+	watcher := startFakeWatcher(t)
+	var ready atomic.Int32
+	for run := range 2 {
+		var exited bool
+		err := runChecked(t, func(onReady func()) error {
+			return RunE(func() {
+				ready.Add(1)
+				onReady()
+			}, func() { exited = true })
+		}, func() {
+			defer Quit()
+			if len(slices.Collect(Items())) != 0 {
+				t.Errorf("run #%d: menu items of the previous run are kept", run)
+			}
+			AddMenuItem(fmt.Sprint("Run ", run), "")
+			waitFor(t, func() bool { return len(watcher.registered()) > run && Registered() })
+		})
+		if err != nil {
+			t.Fatalf("run #%d failed: %v", run, err)
+		}
+		if !exited {
+			t.Errorf("run #%d: onExit is not called", run)
+		}
+	}
+	if n := ready.Load(); n != 2 {
+		t.Errorf("onReady is called %d times", n)
+	}
+}
+
+func TestMultipleTrays(t *testing.T) {
+	watcher := startFakeWatcher(t)
+	second, err := New(WithID("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := AddMenuItem("First", "")
+	defer ResetMenu()
+	item := second.AddMenuItem("Second", "")
+	if FindItem(item.ID()) != nil || second.FindItem(first.ID()) != nil {
+		t.Error("trays share menu items")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- second.RunContext(ctx, nil)
+	}()
+	waitFor(t, func() bool { return len(watcher.registered()) == 1 && second.Registered() })
+	err = runChecked(t, func(onReady func()) error { return RunContext(ctx, onReady) }, func() {
+		defer cancel()
+		waitFor(t, func() bool { return len(watcher.registered()) == 2 && Registered() })
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error of the default tray: %v", err)
+	}
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error of the second tray: %v", err)
+	}
+	items := watcher.registered()
+	if !strings.HasSuffix(items[0], second.native.path) || !strings.HasSuffix(items[1], path) || items[0] == items[1] {
+		t.Errorf("unexpected registered items: %v", items)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	watcher := startFakeWatcher(t)
+	SetReconnectDelay(time.Millisecond, 10*time.Millisecond)
+	defer SetReconnectDelay(DefaultReconnectMinDelay, DefaultReconnectMaxDelay)
+	closeConn := func() {
+		defaultTray.native.lock.Lock()
+		conn := defaultTray.native.conn
+		defaultTray.native.lock.Unlock()
+		conn.Close()
+	}
+
+	err := runChecked(t, func(onReady func()) error { return RunE(onReady, nil) }, func() {
+		defer Quit()
+		SetTitle("Title")
+		AddMenuItem("Item", "")
+		waitFor(t, Registered)
+		closeConn()
+		waitFor(t, func() bool { return len(watcher.registered()) == 2 && Registered() })
+		if title, err := watcher.property(path, "org.kde.StatusNotifierItem.Title"); err != nil || title != "Title" {
+			t.Errorf("title is not restored: %v, %v", title, err)
+		}
+		if items := watcher.registered(); items[0] == items[1] {
+			t.Error("the tray is not reconnected")
+		}
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	SetReconnectDelay(0, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = runChecked(t, func(onReady func()) error { return RunContext(ctx, onReady) }, func() {
+		defer func() {
+			// the lost connection ends the run unless the check has failed
+			if t.Failed() {
+				cancel()
+			}
+		}()
+		waitFor(t, Registered)
+		closeConn()
+	})
+	if !errors.Is(err, ErrConnectionLost) {
+		t.Errorf("unexpected error without reconnection: %v", err)
+	}
+}
+
+func TestRegistrationState(t *testing.T) {
+	watcher := startFakeWatcher(t)
+	setCheckInterval := func(interval time.Duration) {
+		defaultTray.native.lock.Lock()
+		defaultTray.native.checkInterval = interval
+		defaultTray.native.lock.Unlock()
+	}
+	setCheckInterval(10 * time.Millisecond)
+	defer setCheckInterval(registrationCheckInterval)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := RegistrationChanges(ctx)
+	eventsCtx, stopEvents := context.WithCancel(context.Background())
+	events := Events(eventsCtx)
+	if state := <-changes; state != StateUnregistered {
+		t.Errorf("unexpected initial state: %v", state)
+	}
+	err := runChecked(t, func(onReady func()) error { return RunContext(ctx, onReady) }, func() {
+		defer cancel()
+		waitFor(t, Registered)
+		if state := <-changes; state != StateRegistered {
+			t.Errorf("unexpected state change: %v", state)
+		}
+		watcher.setHost(false)
+		waitFor(t, func() bool { return Registration() == StateNoHost })
+		watcher.setHost(true)
+		waitFor(t, Registered)
+
+		// the watcher has lost the tray
+		registrations := len(watcher.registered())
+		watcher.forget()
+		waitFor(t, func() bool { return len(watcher.registered()) > registrations })
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if Registered() {
+		t.Error("the tray is registered after quit")
+	}
+	for range changes {
+	}
+
+	// every state change is published by the events
+	stopEvents()
+	var states []RegistrationState
+	for e := range events {
+		switch e.Type {
+		case EventRegistered, EventUnregistered:
+			if registered := e.State == StateRegistered || e.State == StateNoHost; registered != (e.Type == EventRegistered) {
+				t.Errorf("unexpected event %v of the state %v", e.Type, e.State)
+			}
+			states = append(states, e.State)
+		}
+	}
+	want := []RegistrationState{StateRegistered, StateNoHost, StateRegistered, StateUnregistered}
+	if !slices.Equal(states, want) {
+		t.Errorf("unexpected registration events %v", states)
+	}
+}
+
+func TestCallerProvidedConnection(t *testing.T) {
+	watcher := startFakeWatcher(t)
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	withConn, err := New(WithConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for run := range 2 {
+		ctx, cancel := context.WithCancel(context.Background())
+		err = runChecked(t, func(onReady func()) error { return withConn.RunContext(ctx, onReady) }, func() {
+			defer cancel()
+			waitFor(t, func() bool { return len(watcher.registered()) == run+1 && withConn.Registered() })
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if !conn.Connected() {
+			t.Fatal("the caller provided connection is closed")
+		}
+	}
+	if items := watcher.registered(); items[0] != conn.Names()[0]+withConn.native.path || items[0] != items[1] {
+		t.Errorf("the tray is not registered from the caller provided connection: %v", items)
+	}
+
+	withAddress, err := New(WithBusAddress(os.Getenv("DBUS_SESSION_BUS_ADDRESS")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = runChecked(t, func(onReady func()) error { return withAddress.RunContext(ctx, onReady) }, func() {
+		defer cancel()
+		waitFor(t, func() bool { return len(watcher.registered()) == 3 && withAddress.Registered() })
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	badAddress, err := New(WithBusAddress("unix:path=/nonexistent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := badAddress.RunE(nil, nil); !errors.Is(err, ErrNoSessionBus) {
+		t.Errorf("unexpected error of the bad address: %v", err)
+	}
+}
+
+func TestTeardownKeepsConnection(t *testing.T) {
+	watcher := startFakeWatcher(t)
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tray, err := New(WithConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := watcher.conn.AddMatchSignal(dbus.WithMatchMember("NewStatus")); err != nil {
+		t.Fatal(err)
+	}
+	signals := make(chan *dbus.Signal, 10)
+	watcher.conn.Signal(signals)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err = runChecked(t, func(onReady func()) error { return tray.RunContext(ctx, onReady) }, func() {
+		defer cancel()
+		waitFor(t, tray.Registered)
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	select {
+	case sig := <-signals:
+		if sig.Path != dbus.ObjectPath(tray.native.path) || sig.Body[0] != "Passive" {
+			t.Errorf("unexpected signal: %+v", sig)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the host is not notified")
+	}
+	var hasOwner bool
+	if err := watcher.conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, tray.native.busName()).Store(&hasOwner); err != nil || hasOwner {
+		t.Errorf("the bus name is not released: %v", err)
+	}
+	obj := watcher.conn.Object(conn.Names()[0], dbus.ObjectPath(tray.native.path))
+	if _, err := obj.GetProperty("org.kde.StatusNotifierItem.Title"); err == nil {
+		t.Error("the tray properties are still exported")
+	}
+	if err := obj.Call("org.kde.StatusNotifierItem.Scroll", 0, int32(1), "vertical").Err; err == nil {
+		t.Error("the tray is still exported")
+	}
+	if !conn.Connected() {
+		t.Error("the connection is closed")
+	}
+}
+
+func TestSignalHandling(t *testing.T) {
+	startFakeWatcher(t)
+	tray, err := New(WithSignalHandling(syscall.SIGUSR1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exits atomic.Int32
+	err = runChecked(t, func(onReady func()) error { return tray.RunE(onReady, func() { exits.Add(1) }) }, func() {
+		defer func() {
+			// the signal ends the run unless the check has failed
+			if t.Failed() {
+				tray.Quit()
+			}
+		}()
+		waitFor(t, tray.Registered)
+		if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if n := exits.Load(); n != 1 {
+		t.Errorf("onExit is called %d times", n)
+	}
+	if tray.Registered() {
+		t.Error("the tray is registered after quit")
+	}
+}
+
+func TestStartWithoutWatcher(t *testing.T) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		t.Skipf("no session bus: %v", err)
+	}
+	conn.Close()
+	tr, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tr.Quit)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := tr.Events(ctx)
+	// registrationEvent returns the next registration change from the events
+	registrationEvent := func() Event {
+		t.Helper()
+		for {
+			select {
+			case e := <-events:
+				if e.Type == EventRegistered || e.Type == EventUnregistered {
+					return e
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the registration change is not published")
+			}
+		}
+	}
+
+	ready := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- tr.RunE(func() { close(ready) }, nil)
+	}()
+	select {
+	case <-ready:
+	case err := <-done:
+		t.Fatalf("the tray has quit on start: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("onReady is not called")
+	}
+	if state := tr.Registration(); state != StateNoWatcher {
+		t.Errorf("unexpected registration state: %v", state)
+	}
+	if e := registrationEvent(); e.Type != EventUnregistered || e.State != StateNoWatcher || !errors.Is(e.Err, ErrNoWatcher) {
+		t.Errorf("unexpected event: %+v", e)
+	}
+
+	// the tray keeps running and gets registered when the watcher appears
+	watcher := startFakeWatcher(t)
+	waitFor(t, func() bool { return len(watcher.registered()) > 0 && tr.Registered() })
+	if e := registrationEvent(); e.Type != EventRegistered || e.State != StateRegistered {
+		t.Errorf("unexpected event: %+v", e)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("the tray has quit: %v", err)
+	default:
+	}
+	tr.Quit()
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestReadyInfo(t *testing.T) {
+	watcher := startFakeWatcher(t)
+	tr, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the state set before the tray is exported is published on export
+	tr.SetTitle("early title")
+	var info ReadyInfo
+	err = runChecked(t, func(onReady func()) error {
+		return tr.RunWithReadyInfo(func(ready ReadyInfo) {
+			info = ready
+			onReady()
+		}, nil)
+	}, func() {
+		defer tr.Quit()
+		if !info.Registered || !info.HostPresent || info.BusName != tr.native.busName() || info.Err != nil {
+			t.Errorf("unexpected ready info: %+v", info)
+		}
+		if !tr.Registered() {
+			t.Error("onReady is called before the registration")
+		}
+		title, err := watcher.property(dbus.ObjectPath(tr.native.path), "org.kde.StatusNotifierItem.Title")
+		if err != nil || title != "early title" {
+			t.Errorf("unexpected title %v: %v", title, err)
+		}
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// dib returns the bottom-up 24 bpp DIB of the image filled by c, the icon DIB gets the doubled
+// height and the AND mask making the left column transparent
+func dib(w, h int, c color.NRGBA, icon bool) []byte {
+	le := binary.LittleEndian
+	header := make([]byte, 40)
+	le.PutUint32(header, 40)
+	le.PutUint32(header[4:], uint32(w))
+	dibHeight := h
+	if icon {
+		dibHeight *= 2
+	}
+	le.PutUint32(header[8:], uint32(dibHeight))
+	le.PutUint16(header[12:], 1)
+	le.PutUint16(header[14:], 24)
+	data := header
+	stride := (w*24 + 31) / 32 * 4
+	for range h {
+		line := make([]byte, stride)
+		for x := range w {
+			line[3*x], line[3*x+1], line[3*x+2] = c.B, c.G, c.R
+		}
+		data = append(data, line...)
+	}
+	if icon {
+		maskStride := (w + 31) / 32 * 4
+		for range h {
+			line := make([]byte, maskStride)
+			line[0] = 0x80
+			data = append(data, line...)
+		}
+	}
+	return data
+}
+
+// ico returns the ICO file with the given images
+func ico(images ...[]byte) []byte {
+	le := binary.LittleEndian
+	data := []byte{0, 0, 1, 0, byte(len(images)), 0}
+	offset := 6 + 16*len(images)
+	for _, img := range images {
+		entry := make([]byte, 16)
+		le.PutUint32(entry[8:], uint32(len(img)))
+		le.PutUint32(entry[12:], uint32(offset))
+		data = append(data, entry...)
+		offset += len(img)
+	}
+	for _, img := range images {
+		data = append(data, img...)
+	}
+	return data
+}
+
+func TestReadyInfoWithoutWatcher(t *testing.T) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		t.Skipf("no session bus: %v", err)
+	}
+	conn.Close()
+	tr, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tr.Quit)
+
+	ready := make(chan ReadyInfo, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- tr.RunWithReadyInfo(func(info ReadyInfo) {
+			tr.AddMenuItem("Item", "")
+			ready <- info
+		}, nil)
+	}()
+	var info ReadyInfo
+	select {
+	case info = <-ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("onReady is not called")
+	}
+	if info.Registered || info.HostPresent || info.BusName != tr.native.busName() || !errors.Is(info.Err, ErrNoWatcher) {
+		t.Errorf("unexpected ready info: %+v", info)
+	}
+
+	// the tray isn't torn down under onReady
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("the tray has quit: %v", err)
+	default:
+	}
+	if items := slices.Collect(tr.Items()); len(items) != 1 {
+		t.Errorf("the menu built by onReady is dropped: %v", items)
+	}
+	tr.Quit()
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestConvertToPixelsFormats(t *testing.T) {
+	red := color.NRGBA{R: 0xff, A: 0xff}
+	src := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	for i := 0; i < len(src.Pix); i += 4 {
+		copy(src.Pix[i:], []byte{red.R, red.G, red.B, red.A})
+	}
+	encode := func(encode func(io.Writer, image.Image) error) []byte {
+		var buf bytes.Buffer
+		if err := encode(&buf, src); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	pngData := encode(png.Encode)
+	jpegData := encode(func(w io.Writer, img image.Image) error { return jpeg.Encode(w, img, nil) })
+	gifData := encode(func(w io.Writer, img image.Image) error { return gif.Encode(w, img, nil) })
+	bmpData := append([]byte("BM"), make([]byte, 12)...)
+	bmpData = append(bmpData, dib(4, 2, red, false)...)
+	icoData := ico(dib(16, 16, red, true), pngData)
+
+	for name, data := range map[string][]byte{"png": pngData, "jpeg": jpegData, "gif": gifData, "bmp": bmpData} {
+		pixmaps, err := convertToPixels(data)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if len(pixmaps) != 1 || pixmaps[0].W != 4 || pixmaps[0].H != 2 || len(pixmaps[0].Pix) != 4*4*2 {
+			t.Errorf("%s: unexpected pixmaps: %+v", name, pixmaps)
+		}
+	}
+
+	pixmaps, err := convertToPixels(icoData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pixmaps) != 2 || pixmaps[0].W != 16 || pixmaps[0].H != 16 || pixmaps[1].W != 4 || pixmaps[1].H != 2 {
+		t.Fatalf("unexpected ico pixmaps: %+v", pixmaps)
+	}
+	// the AND mask makes the left column transparent
+	if alpha := pixmaps[0].Pix[0]; alpha != 0 {
+		t.Errorf("masked pixel alpha is %d", alpha)
+	}
+	if alpha := pixmaps[0].Pix[4]; alpha == 0 {
+		t.Error("unmasked pixel is transparent")
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(icoData))
+	if err != nil || format != "ico" || img.Bounds().Dx() != 16 {
+		t.Errorf("the largest ico image is not decoded: %v %v", format, err)
+	}
+	if _, err := convertToPixels(icoData[:30]); !errors.Is(err, ErrBadIcon) {
+		t.Errorf("truncated ico: unexpected error: %v", err)
+	}
+}
+
+func TestDecodeDIBHeaders(t *testing.T) {
+	le := binary.LittleEndian
+	// 2x1 16 bpp DIB with BITMAPV2INFOHEADER keeping the 565 RGB masks
+	header := func(size, w, h int) []byte {
+		header := make([]byte, size)
+		le.PutUint32(header, uint32(size))
+		le.PutUint32(header[4:], uint32(w))
+		le.PutUint32(header[8:], uint32(h))
+		le.PutUint16(header[12:], 1)
+		le.PutUint16(header[14:], 16)
+		le.PutUint32(header[16:], biBitFields)
+		return header
+	}
+	data := header(52, 2, 1)
+	le.PutUint32(data[40:], 0xf800)
+	le.PutUint32(data[44:], 0x07e0)
+	le.PutUint32(data[48:], 0x001f)
+	data = append(data, 0x00, 0xf8, 0x1f, 0x00)
+	img, err := decodeDIB(data, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	red, blue := color.NRGBA{R: 0xff, A: 0xff}, color.NRGBA{B: 0xff, A: 0xff}
+	if c := img.At(0, 0); c != red {
+		t.Errorf("unexpected first pixel %v", c)
+	}
+	if c := img.At(1, 0); c != blue {
+		t.Errorf("unexpected second pixel %v", c)
+	}
+
+	if _, err := decodeDIB(data[:len(data)-1], false); err == nil {
+		t.Error("truncated pixels are decoded")
+	}
+	if _, err := decodeDIB(header(40, maxIconSize+1, 1), false); err == nil {
+		t.Error("oversized DIB is decoded")
+	}
+	if _, err := decodeDIB(header(40, maxIconSize, maxIconSize), false); err == nil {
+		t.Error("DIB without pixels is decoded")
+	}
+}
+
+// opaqueImage hides the concrete image type to test the generic conversion
+type opaqueImage struct{ image.Image }
+
+func TestArgbForImage(t *testing.T) {
+	// half transparent red, opaque green, transparent and half transparent white
+	nrgba := &image.NRGBA{
+		Pix: []byte{
+			0xff, 0x00, 0x00, 0x80, 0x00, 0xff, 0x00, 0xff,
+			0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0x80,
+		},
+		Stride: 8,
+		Rect:   image.Rect(0, 0, 2, 2),
+	}
+	golden := []byte{
+		0x80, 0xff, 0x00, 0x00, 0xff, 0x00, 0xff, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x80, 0xff, 0xff, 0xff,
+	}
+	rgba := image.NewRGBA(nrgba.Rect)
+	draw.Draw(rgba, rgba.Rect, nrgba, image.Point{}, draw.Src)
+	paletted := image.NewPaletted(nrgba.Rect, color.Palette{
+		color.NRGBA{R: 0xff, A: 0x80}, color.NRGBA{G: 0xff, A: 0xff},
+		color.NRGBA{}, color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0x80},
+	})
+	paletted.Pix = []byte{0, 1, 2, 3}
+
+	for name, img := range map[string]image.Image{
+		"nrgba":    nrgba,
+		"rgba":     rgba,
+		"paletted": paletted,
+		"generic":  opaqueImage{nrgba},
+	} {
+		if data := argbForImage(img); !bytes.Equal(data, golden) {
+			t.Errorf("%s: got % x, want % x", name, data, golden)
+		}
+	}
+
+	// the sub image keeps its bounds, so its pixels don't start at (0, 0)
+	sub := nrgba.SubImage(image.Rect(1, 1, 2, 2))
+	if data := argbForImage(sub); !bytes.Equal(data, golden[12:]) {
+		t.Errorf("sub image: got % x, want % x", data, golden[12:])
+	}
+
+	// the fast paths match the generic conversion for every alpha
+	for a := range 256 {
+		c := color.RGBA{R: byte(a / 3), G: byte(a / 2), B: byte(a), A: byte(a)}
+		rgba := image.NewRGBA(image.Rect(0, 0, 1, 1))
+		rgba.SetRGBA(0, 0, c)
+		if fast, generic := argbForImage(rgba), argbForImage(opaqueImage{rgba}); !bytes.Equal(fast, generic) {
+			t.Fatalf("%v: fast path % x, generic % x", c, fast, generic)
+		}
+	}
+}
+
+func BenchmarkArgbForImage(b *testing.B) {
+	rect := image.Rect(0, 0, 256, 256)
+	nrgba := image.NewNRGBA(rect)
+	for i := range nrgba.Pix {
+		nrgba.Pix[i] = byte(i)
+	}
+	rgba := image.NewRGBA(rect)
+	draw.Draw(rgba, rect, nrgba, image.Point{}, draw.Src)
+	paletted := image.NewPaletted(rect, palette.Plan9)
+	draw.Draw(paletted, rect, nrgba, image.Point{}, draw.Src)
+
+	for _, bench := range []struct {
+		name string
+		img  image.Image
+	}{
+		{"NRGBA", nrgba},
+		{"RGBA", rgba},
+		{"Paletted", paletted},
+		{"Generic", opaqueImage{nrgba}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for b.Loop() {
+				argbForImage(bench.img)
+			}
+		})
+	}
+}
+
+func TestIconImage(t *testing.T) {
+	watcher := startFakeWatcher(t)
+	tr, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	img.Pix[3] = 0xff
+	err = runTray(t, tr, func() {
+		defer tr.Quit()
+		path := dbus.ObjectPath(tr.native.path)
+		tr.SetIconImage(img)
+		tr.SetAttentionIconImage(img)
+		tr.SetStatus(StatusNeedsAttention)
+		for _, name := range []string{"IconPixmap", "AttentionIconPixmap"} {
+			v, err := watcher.property(path, "org.kde.StatusNotifierItem."+name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var pixmaps []PX
+			if err := dbus.Store([]interface{}{v}, &pixmaps); err != nil {
+				t.Fatal(err)
+			}
+			if len(pixmaps) != 1 || pixmaps[0].W != 3 || pixmaps[0].H != 2 || !bytes.Equal(pixmaps[0].Pix, argbForImage(img)) {
+				t.Errorf("unexpected %s: %+v", name, pixmaps)
+			}
+		}
+		if status, err := watcher.property(path, "org.kde.StatusNotifierItem.Status"); err != nil || status != "NeedsAttention" {
+			t.Errorf("unexpected status %v: %v", status, err)
+		}
+
+		item := tr.AddMenuItem("item", "")
+		item.SetIconImage(img)
+		tr.native.menuLock.RLock()
+		layout, _ := tr.native.findLayout(int32(item.id))
+		iconData := layout.V1["icon-data"].Value().([]byte)
+		tr.native.menuLock.RUnlock()
+		if decoded, err := png.Decode(bytes.NewReader(iconData)); err != nil || decoded.Bounds() != img.Bounds() {
+			t.Errorf("unexpected menu item icon: %v", err)
+		}
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestIconCacheSuppressesUnchangedIcon(t *testing.T) {
+	watcher := startFakeWatcher(t)
+	tr, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(c color.NRGBA) []byte {
+		img := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+		img.SetNRGBA(0, 0, c)
+		data, err := encodePNG(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	red, green := encode(color.NRGBA{R: 0xff, A: 0xff}), encode(color.NRGBA{G: 0xff, A: 0xff})
+	// the icon set before the run is exported with the cached pixmaps
+	if err := tr.SetIconE(red); err != nil {
+		t.Fatal(err)
+	}
+
+	err = runTray(t, tr, func() {
+		defer tr.Quit()
+		path := dbus.ObjectPath(tr.native.path)
+		if err := watcher.conn.AddMatchSignal(dbus.WithMatchObjectPath(path), dbus.WithMatchInterface("org.kde.StatusNotifierItem")); err != nil {
+			t.Fatal(err)
+		}
+		signals := make(chan *dbus.Signal, 10)
+		watcher.conn.Signal(signals)
+		defer watcher.conn.RemoveSignal(signals)
+
+		before := GetIconCacheStats()
+		for _, icon := range [][]byte{red, red, green, red} {
+			if err := tr.SetIconE(icon); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tr.SetTitle("title")
+		tr.SetTitle("title")
+		stats := GetIconCacheStats()
+		if hits := stats.Hits - before.Hits; hits < 2 {
+			t.Errorf("the cached icons are decoded again: %d hits", hits)
+		}
+		if suppressed := stats.Suppressed - before.Suppressed; suppressed != 3 {
+			t.Errorf("%d updates are suppressed, want 3", suppressed)
+		}
+		if stats.Entries == 0 || stats.Entries > iconCacheSize {
+			t.Errorf("unexpected cache size %d", stats.Entries)
+		}
+
+		// the signals are delivered in order, so NewTitle comes right after the NewIcon signals
+		var members []string
+		for len(members) == 0 || members[len(members)-1] != "NewTitle" {
+			select {
+			case s := <-signals:
+				if s.Path == path {
+					members = append(members, s.Name[strings.LastIndex(s.Name, ".")+1:])
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no NewTitle signal: %v", members)
+			}
+		}
+		if want := []string{"NewIcon", "NewIcon", "NewTitle"}; !slices.Equal(members, want) {
+			t.Errorf("unexpected signals %v, want %v", members, want)
+		}
+
+		// publishing the icons doesn't change the cached ones
+		for _, icon := range [][]byte{red, green} {
+			cached, err := icons.decode(icon)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded, _ := convertToPixels(icon); !slices.EqualFunc(cached, decoded, func(a, b PX) bool {
+				return a.W == b.W && a.H == b.H && bytes.Equal(a.Pix, b.Pix)
+			}) {
+				t.Error("the cached icon is changed")
+			}
+		}
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestIconCacheEvictsOldest(t *testing.T) {
+	cache := newIconCache(2)
+	var encoded [][]byte
+	for i := range 3 {
+		img := image.NewGray(image.Rect(0, 0, i+1, 1))
+		data, err := encodePNG(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded = append(encoded, data)
+		if _, err := cache.decode(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := cache.decode(encoded[2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.decode(encoded[0]); err != nil {
+		t.Fatal(err)
+	}
+	if cache.hits != 1 || cache.misses != 4 || cache.order.Len() != 2 {
+		t.Errorf("unexpected cache state: %d hits, %d misses, %d entries", cache.hits, cache.misses, cache.order.Len())
+	}
+}
+
+// solid returns the opaque image of the color
+func solid(w, h int, c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Rect, image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+// apng makes APNG of the opaque images of the same size, the frame delays are i+1 tenths of second
+func apng(t *testing.T, images ...image.Image) []byte {
+	chunk := func(buf []byte, typ string, data []byte) []byte {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
+		start := len(buf)
+		buf = append(buf, typ...)
+		buf = append(buf, data...)
+		return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf[start:]))
+	}
+	buf := []byte(pngSignature)
+	seq := uint32(0)
+	for i, img := range images {
+		data, err := encodePNG(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks, err := readPNGChunks(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			buf = chunk(buf, "IHDR", chunks[0].data)
+			buf = chunk(buf, "acTL", binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, uint32(len(images))), 0))
+		}
+		fctl := binary.BigEndian.AppendUint32(nil, seq)
+		fctl = binary.BigEndian.AppendUint32(fctl, uint32(img.Bounds().Dx()))
+		fctl = binary.BigEndian.AppendUint32(fctl, uint32(img.Bounds().Dy()))
+		fctl = append(fctl, make([]byte, 8)...)
+		fctl = binary.BigEndian.AppendUint16(fctl, uint16(i+1))
+		fctl = binary.BigEndian.AppendUint16(fctl, 10)
+		fctl = append(fctl, 0, 0)
+		buf = chunk(buf, "fcTL", fctl)
+		seq++
+		for _, c := range chunks {
+			if c.typ != "IDAT" {
+				continue
+			}
+			if i == 0 {
+				buf = chunk(buf, "IDAT", c.data)
+			} else {
+				buf = chunk(buf, "fdAT", append(binary.BigEndian.AppendUint32(nil, seq), c.data...))
+				seq++
+			}
+		}
+	}
+	return chunk(buf, "IEND", nil)
+}
+
+func TestDecodeAnimation(t *testing.T) {
+	red, green := color.NRGBA{R: 0xff, A: 0xff}, color.NRGBA{G: 0xff, A: 0xff}
+	images := []image.Image{solid(4, 4, red), solid(4, 4, green)}
+	frames, delays, err := decodeAnimation(apng(t, images...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 || !slices.Equal(delays, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}) {
+		t.Fatalf("unexpected apng frames: %d, %v", len(frames), delays)
+	}
+	for i, frame := range frames {
+		if !bytes.Equal(argbForImage(frame), argbForImage(images[i])) {
+			t.Errorf("apng frame %d differs", i)
+		}
+	}
+
+	// the second GIF frame covers the left half of the first one
+	palette := color.Palette{color.Transparent, red, green}
+	first := image.NewPaletted(image.Rect(0, 0, 4, 4), palette)
+	draw.Draw(first, first.Rect, image.NewUniform(red), image.Point{}, draw.Src)
+	second := image.NewPaletted(image.Rect(0, 0, 2, 4), palette)
+	draw.Draw(second, second.Rect, image.NewUniform(green), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	err = gif.EncodeAll(&buf, &gif.GIF{Image: []*image.Paletted{first, second}, Delay: []int{0, 30}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames, delays, err = decodeAnimation(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 || !slices.Equal(delays, []time.Duration{defaultAnimationDelay, 300 * time.Millisecond}) {
+		t.Fatalf("unexpected gif frames: %d, %v", len(frames), delays)
+	}
+	if c := color.NRGBAModel.Convert(frames[1].At(0, 0)); c != green {
+		t.Errorf("unexpected covered pixel %v", c)
+	}
+	if c := color.NRGBAModel.Convert(frames[1].At(3, 0)); c != red {
+		t.Errorf("unexpected uncovered pixel %v", c)
+	}
+
+	if _, _, err := decodeAnimation([]byte("not an animation")); err == nil {
+		t.Error("no error for bad animation")
+	}
+
+	// the oversized canvas is rejected before the frames are decoded
+	buf.Reset()
+	err = gif.EncodeAll(&buf, &gif.GIF{
+		Image:  []*image.Paletted{second},
+		Delay:  []int{0},
+		Config: image.Config{ColorModel: palette, Width: maxIconSize + 1, Height: 4},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := decodeAnimation(buf.Bytes()); err == nil {
+		t.Error("oversized gif is decoded")
+	}
+	if _, _, err := decodeAnimation(apng(t, solid(maxIconSize+1, 1, red))); err == nil {
+		t.Error("oversized apng is decoded")
+	}
+}
+
+func TestIconAnimation(t *testing.T) {
+	startFakeWatcher(t)
+	tr, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames [][]byte
+	var pixmaps [][]PX
+	for _, c := range []color.NRGBA{{R: 0xff, A: 0xff}, {G: 0xff, A: 0xff}, {B: 0xff, A: 0xff}} {
+		data, err := encodePNG(solid(2, 2, c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, data)
+		pixmaps = append(pixmaps, pixmapsForImage(solid(2, 2, c)))
+	}
+	iconIs := func(frame int) func() bool {
+		return func() bool {
+			tr.native.lock.Lock()
+			defer tr.native.lock.Unlock()
+			return equalPixmaps(tr.native.iconData, pixmaps[frame])
+		}
+	}
+	currentFrame := func() int {
+		for i := range pixmaps {
+			if iconIs(i)() {
+				return i
+			}
+		}
+		return -1
+	}
+	// stable checks that the frame isn't changed for a few intervals,
+	// the status change is applied by the next frame, so it waits for it first
+	stable := func() bool {
+		time.Sleep(2 * minAnimationInterval)
+		frame := currentFrame()
+		time.Sleep(4 * minAnimationInterval)
+		return frame == currentFrame()
+	}
+
+	err = runTray(t, tr, func() {
+		defer tr.Quit()
+		if _, err := tr.SetIconAnimation(append(slices.Clone(frames), []byte("bad")), time.Millisecond); !errors.Is(err, ErrBadIcon) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		animation, err := tr.SetIconAnimation(frames, time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range frames {
+			waitFor(t, iconIs(i))
+		}
+
+		animation.Pause()
+		if !stable() {
+			t.Error("the paused animation is playing")
+		}
+		animation.Resume()
+		waitFor(t, func() bool { return !stable() })
+
+		tr.SetStatus(StatusPassive)
+		if !stable() {
+			t.Error("the animation is playing while the tray is passive")
+		}
+		tr.SetStatus(StatusActive)
+		waitFor(t, func() bool { return !stable() })
+
+		// the new animation replaces the current one
+		gifData := &bytes.Buffer{}
+		palette := color.Palette{color.NRGBA{R: 0xff, A: 0xff}}
+		if err := gif.Encode(gifData, image.NewPaletted(image.Rect(0, 0, 2, 2), palette), nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tr.SetAnimatedIcon(gifData.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, iconIs(0))
+		if !stable() || !iconIs(0)() {
+			t.Error("the replaced animation is playing")
+		}
+		tr.stopAnimation()
+		tr.native.lock.Lock()
+		tr.native.iconData = nil
+		tr.native.lock.Unlock()
+		if !stable() || currentFrame() != -1 {
+			t.Error("the stopped animation is playing")
+		}
+
+		// the static icon stops the animation
+		setIcons := map[string]func(){
+			"SetIconE":     func() { _ = tr.SetIconE(frames[1]) },
+			"SetIconImage": func() { tr.SetIconImage(solid(2, 2, color.NRGBA{G: 0xff, A: 0xff})) },
+		}
+		for name, setIcon := range setIcons {
+			if _, err := tr.SetIconAnimation(frames, time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, func() bool { return !stable() })
+			setIcon()
+			if !stable() || !iconIs(1)() {
+				t.Errorf("%s: the animation is playing after the icon is set", name)
+			}
+		}
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestBadge(t *testing.T) {
+	watcher := startFakeWatcher(t)
+	tr, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pixel returns the ARGB pixel of the pixmap
+	pixel := func(p PX, x, y int) [4]byte {
+		i := (y*p.W + x) * 4
+		return [4]byte(p.Pix[i : i+4])
+	}
+	blue := color.NRGBA{B: 0xff, A: 0xff}
+	icon := ico(dib(16, 16, blue, true), dib(32, 32, blue, true))
+
+	err = runTray(t, tr, func() {
+		defer tr.Quit()
+		path := dbus.ObjectPath(tr.native.path)
+		for _, member := range []string{"NewIcon", "PropertiesChanged"} {
+			if err := watcher.conn.AddMatchSignal(dbus.WithMatchObjectPath(path), dbus.WithMatchMember(member)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		signals := make(chan *dbus.Signal, 10)
+		watcher.conn.Signal(signals)
+		defer watcher.conn.RemoveSignal(signals)
+		// exported returns the pixmaps published on the bus by the change before the NewIcon signal.
+		// They are taken from PropertiesChanged, as godbus may encode the reply of the property
+		// request after the next change has started to overwrite the property value.
+		exported := func() []PX {
+			var pixmaps []PX
+			for {
+				select {
+				case s := <-signals:
+					if s.Path != path {
+						continue
+					}
+					if s.Name == "org.kde.StatusNotifierItem.NewIcon" {
+						return pixmaps
+					}
+					if changed, ok := s.Body[1].(map[string]dbus.Variant); ok {
+						if v, ok := changed["IconPixmap"]; ok {
+							pixmaps = nil
+							if err := v.Store(&pixmaps); err != nil {
+								t.Fatal(err)
+							}
+						}
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("no NewIcon signal")
+				}
+			}
+		}
+
+		if err := tr.SetIconE(icon); err != nil {
+			t.Fatal(err)
+		}
+		exported()
+		tr.SetBadgeStyle(BadgeStyle{Background: color.NRGBA{G: 0xff, A: 0xff}})
+		tr.SetBadge(150)
+		pixmaps := exported()
+		if len(pixmaps) != 2 {
+			t.Fatalf("unexpected pixmaps: %d", len(pixmaps))
+		}
+		for _, p := range pixmaps {
+			// the badge is green with the white count in the top right corner
+			if c := pixel(p, p.W-3, p.H/8); c != [4]byte{0xff, 0, 0xff, 0} {
+				t.Errorf("%dx%d: unexpected badge background % x", p.W, p.H, c)
+			}
+			white := 0
+			for y := range p.H / 2 {
+				for x := range p.W {
+					if pixel(p, x, y) == [4]byte{0xff, 0xff, 0xff, 0xff} {
+						white++
+					}
+				}
+			}
+			if white == 0 {
+				t.Errorf("%dx%d: no count is drawn", p.W, p.H)
+			}
+			if c := pixel(p, 1, p.H-1); c != [4]byte{0xff, 0, 0, 0xff} {
+				t.Errorf("%dx%d: the icon is changed out of the badge: % x", p.W, p.H, c)
+			}
+		}
+		// the cached icon isn't changed by drawing
+		cached, err := icons.decode(icon)
+		if err != nil || pixel(cached[0], 15, 4) != [4]byte{0xff, 0, 0, 0xff} {
+			t.Errorf("the cached icon is changed: %v", err)
+		}
+
+		// the badge is drawn on the new icon
+		tr.SetBadge(5)
+		exported()
+		if err := tr.SetIconE(encodeTestPNG(t, solid(16, 16, blue))); err != nil {
+			t.Fatal(err)
+		}
+		if pixmaps := exported(); len(pixmaps) != 1 || pixel(pixmaps[0], 15, 3) != [4]byte{0xff, 0, 0xff, 0} {
+			t.Errorf("the badge isn't drawn on the new icon: %+v", pixmaps)
+		}
+
+		tr.ClearBadge()
+		if pixmaps := exported(); len(pixmaps) != 1 || pixel(pixmaps[0], 15, 3) != [4]byte{0xff, 0, 0, 0xff} {
+			t.Errorf("the badge isn't cleared: %+v", pixmaps)
+		}
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func encodeTestPNG(t *testing.T, img image.Image) []byte {
+	data, err := encodePNG(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestProgress(t *testing.T) {
+	watcher := startFakeWatcher(t)
+	tr, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pixel := func(x, y int) [4]byte {
+		tr.native.lock.Lock()
+		defer tr.native.lock.Unlock()
+		p := tr.native.decoratedIcon()[0]
+		i := (y*p.W + x) * 4
+		return [4]byte(p.Pix[i : i+4])
+	}
+	blue := [4]byte{0xff, 0, 0, 0xff}
+	green := [4]byte{0xff, 0, 0xff, 0}
+
+	err = runTray(t, tr, func() {
+		defer tr.Quit()
+		path := dbus.ObjectPath(tr.native.path)
+		tr.SetIconImage(solid(16, 16, color.NRGBA{B: 0xff, A: 0xff}))
+		if err := watcher.conn.AddMatchSignal(dbus.WithMatchObjectPath(path), dbus.WithMatchMember("NewIcon")); err != nil {
+			t.Fatal(err)
+		}
+		signals := make(chan *dbus.Signal, 100)
+		watcher.conn.Signal(signals)
+		defer watcher.conn.RemoveSignal(signals)
+
+		tr.SetProgressStyle(ProgressStyle{Shape: ProgressBar, Color: color.NRGBA{G: 0xff, A: 0xff}, Track: color.Transparent})
+		start := time.Now()
+		for i := range 51 {
+			tr.SetProgress(float64(i) / 100)
+		}
+		// the first update is published at once and the latest one after the interval
+		var times []time.Duration
+		for len(times) < 2 {
+			select {
+			case s := <-signals:
+				if s.Path == path {
+					times = append(times, time.Since(start))
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no deferred progress: %v", times)
+			}
+		}
+		if times[1] < progressInterval*9/10 {
+			t.Errorf("the deferred progress is published after %v", times[1])
+		}
+		if c := pixel(7, 15); c != green {
+			t.Errorf("unexpected bar % x", c)
+		}
+		if c := pixel(8, 15); c != blue {
+			t.Errorf("unexpected bar track % x", c)
+		}
+		if c := pixel(7, 0); c != blue {
+			t.Errorf("the icon is changed out of the bar: % x", c)
+		}
+		time.Sleep(2 * progressInterval)
+		for len(signals) > 0 {
+			if s := <-signals; s.Path == path {
+				t.Error("more than two NewIcon signals for 51 progress updates")
+			}
+		}
+
+		// the ring is filled clockwise from the top
+		tr.SetProgressStyle(ProgressStyle{Color: color.NRGBA{G: 0xff, A: 0xff}})
+		tr.SetProgress(0.25)
+		if c := pixel(14, 7); c != green {
+			t.Errorf("unexpected ring % x", c)
+		}
+		if c := pixel(0, 8); c == green || c == blue {
+			t.Errorf("unexpected ring track % x", c)
+		}
+		if c := pixel(8, 8); c != blue {
+			t.Errorf("the icon is changed inside the ring: % x", c)
+		}
+
+		tr.ClearProgress()
+		if c := pixel(14, 7); c != blue {
+			t.Errorf("the progress isn't cleared: % x", c)
+		}
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
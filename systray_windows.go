@@ -4,10 +4,12 @@ package systray
 
 import (
 	"crypto/md5"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"image"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"sort"
@@ -16,6 +18,7 @@ import (
 	"syscall"
 	"unsafe"
 
+	"github.com/godbus/dbus/v5"
 	"golang.org/x/sys/windows"
 )
 
@@ -255,7 +258,7 @@ func (t *winTray) setIcon(src string) error {
 
 	h, err := t.loadIconFrom(src)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", ErrBadIcon, err)
 	}
 
 	t.muNID.Lock()
@@ -307,7 +310,7 @@ func (t *winTray) wndProc(hWnd windows.Handle, message uint32, wParam, lParam ui
 		menuItemId := int32(wParam)
 		// https://docs.microsoft.com/en-us/windows/win32/menurc/wm-command#menus
 		if menuItemId != -1 {
-			systrayMenuItemSelected(uint32(wParam))
+			defaultTray.menuItemSelected(uint32(wParam), 0, nil)
 		}
 	case WM_CLOSE:
 		pDestroyWindow.Call(uintptr(t.window))
@@ -322,7 +325,7 @@ func (t *winTray) wndProc(hWnd windows.Handle, message uint32, wParam, lParam ui
 			t.nid.delete()
 		}
 		t.muNID.Unlock()
-		runSystrayExit()
+		defaultTray.runExit()
 	case t.wmSystrayMessage:
 		switch lParam {
 		case WM_RBUTTONUP, WM_LBUTTONUP:
@@ -881,19 +884,41 @@ func create32BitHBitmap(hDC uintptr, cx, cy int32) (uintptr, error) {
 	return hBitmap, nil
 }
 
-func registerSystray() {
+// tray is the platform specific part of the tray, Windows has only the default tray which is wt
+type tray struct{}
+
+// multipleTrays means that New can create additional trays
+const multipleTrays = false
+
+func newNativeTray(*Tray) *tray {
+	return &tray{}
+}
+
+func (*tray) setBusAddress(string) {
+}
+
+// WithConn does nothing, the caller provided D-Bus connection is only used on Linux.
+func WithConn(*dbus.Conn) Option {
+	return func(*Tray) {}
+}
+
+// SetID does nothing, the ID is only available on Linux.
+func (*Tray) SetID(id string) {
+}
+
+func (t *Tray) registerSystray() error {
 	if err := wt.initInstance(); err != nil {
-		log.Printf("systray error: unable to init instance: %s\n", err)
-		return
+		return fmt.Errorf("unable to init instance: %w", err)
 	}
 
 	if err := wt.createMenu(); err != nil {
-		log.Printf("systray error: unable to create menu: %s\n", err)
-		return
+		return fmt.Errorf("unable to create menu: %w", err)
 	}
 
 	wt.initialized.Store(true)
-	systrayReady()
+	t.registration.set(StateRegistered)
+	t.ready(ReadyInfo{Registered: true, HostPresent: true})
+	return nil
 }
 
 var m = &struct {
@@ -905,21 +930,31 @@ var m = &struct {
 	Pt           point
 }{}
 
-func nativeLoop() {
+func (*Tray) nativeLoop() {
 	for doNativeTick() {
 	}
 }
 
-func nativeEnd() {
+func (t *Tray) nativeLoopE() error {
+	t.nativeLoop()
+	return nil
 }
 
-func nativeStart() {
+func (*Tray) nativeEnd() {
+}
+
+func (*Tray) nativeStart() {
 	go func() {
 		for doNativeTick() {
 		}
 	}()
 }
 
+func (t *Tray) nativeStartE() error {
+	t.nativeStart()
+	return nil
+}
+
 func doNativeTick() bool {
 	ret, _, err := pGetMessage.Call(uintptr(unsafe.Pointer(m)), 0, 0, 0)
 
@@ -929,7 +964,7 @@ func doNativeTick() bool {
 	// https://msdn.microsoft.com/en-us/library/windows/desktop/ms644936(v=vs.85).aspx
 	switch int32(ret) {
 	case -1:
-		log.Printf("systray error: message loop failure: %s\n", err)
+		logger().Error("message loop failure", "err", err)
 		return false
 	case 0:
 		return false
@@ -940,7 +975,7 @@ func doNativeTick() bool {
 	return true
 }
 
-func quit() {
+func (t *Tray) quit() {
 	const WM_CLOSE = 0x0010
 
 	pPostMessage.Call(
@@ -955,12 +990,22 @@ func quit() {
 		wt.nid.delete()
 	}
 	wt.muNID.Unlock()
-	runSystrayExit()
+	t.runExit()
 }
 
 func setInternalLoop(bool) {
 }
 
+func (*Tray) nativeReset() {
+	wt.initialized.Store(false)
+}
+
+func (*Tray) beginBatch() {
+}
+
+func (*Tray) commitBatch() {
+}
+
 func iconBytesToFilePath(iconBytes []byte) (string, error) {
 	bh := md5.Sum(iconBytes)
 	dataHash := hex.EncodeToString(bh[:])
@@ -974,32 +1019,27 @@ func iconBytesToFilePath(iconBytes []byte) (string, error) {
 	return iconFilePath, nil
 }
 
-// SetIcon sets the systray icon.
-// iconBytes should be the content of .ico for windows and .ico/.jpg/.png
-// for other platforms.
-func SetIcon(iconBytes []byte) {
+// setIcon sets the tray icon, the error wraps ErrBadIcon when the icon can't be loaded.
+// The current animation isn't stopped.
+func (*Tray) setIcon(iconBytes []byte) error {
 	iconFilePath, err := iconBytesToFilePath(iconBytes)
 	if err != nil {
-		log.Printf("systray error: unable to write icon data to temp file: %s\n", err)
-		return
+		return fmt.Errorf("unable to write icon data to temp file: %w", err)
 	}
 	if err := wt.setIcon(iconFilePath); err != nil {
-		log.Printf("systray error: unable to set icon: %s\n", err)
-		return
+		return fmt.Errorf("unable to set icon: %w", err)
 	}
+	return nil
 }
 
-// SetTemplateIcon sets the systray icon as a template icon (on macOS), falling back
-// to a regular icon on other platforms.
-// templateIconBytes and iconBytes should be the content of .ico for windows and
-// .ico/.jpg/.png for other platforms.
-func SetTemplateIcon(templateIconBytes []byte, regularIconBytes []byte) {
-	SetIcon(regularIconBytes)
+// SetTemplateIcon sets the tray icon, the template icon is only used on macOS.
+func (t *Tray) SetTemplateIcon(templateIconBytes []byte, regularIconBytes []byte) {
+	t.SetIcon(regularIconBytes)
 }
 
-// SetTitle sets the systray title, only available on Mac and Linux.
-func SetTitle(title string) {
-	// do nothing
+// SetTitleE does nothing, the title is only available on Mac and Linux.
+func (*Tray) SetTitleE(title string) error {
+	return nil
 }
 
 func (item *MenuItem) parentId() uint32 {
@@ -1014,45 +1054,46 @@ func (item *MenuItem) parentId() uint32 {
 func (item *MenuItem) SetIcon(iconBytes []byte) {
 	iconFilePath, err := iconBytesToFilePath(iconBytes)
 	if err != nil {
-		log.Printf("systray error: unable to write icon data to temp file: %s\n", err)
+		logger().Error("unable to write icon data to temp file", "item", item.id, "err", err)
 		return
 	}
 
 	h, err := wt.loadIconFrom(iconFilePath)
 	if err != nil {
-		log.Printf("systray error: unable to load icon from temp file: %s\n", err)
+		logger().Error("unable to load icon from temp file", "item", item.id, "err", err)
 		return
 	}
 
 	h, err = iconToBitmap(h)
 	if err != nil {
-		log.Printf("systray error: unable to convert icon to bitmap: %s\n", err)
+		logger().Error("unable to convert icon to bitmap", "item", item.id, "err", err)
 		return
 	}
 	wt.muMenuItemIcons.Lock()
 	wt.menuItemIcons[uint32(item.id)] = h
 	wt.muMenuItemIcons.Unlock()
 
-	err = wt.addOrUpdateMenuItem(uint32(item.id), item.parentId(), item.title, item.disabled, item.checked)
+	state := item.state.Load()
+	err = wt.addOrUpdateMenuItem(uint32(item.id), item.parentId(), state.title, state.disabled, state.checked)
 	if err != nil {
-		log.Printf("systray error: unable to addOrUpdateMenuItem: %s\n", err)
+		logger().Error("unable to add or update menu item", "item", item.id, "err", err)
 		return
 	}
 }
 
-// SetTooltip sets the systray tooltip to display on mouse hover of the tray icon,
-// only available on Mac and Windows.
-func SetTooltip(tooltip string) {
+// SetTooltipE sets the tray tooltip like SetTooltip does, but returns the error instead of logging it.
+func (*Tray) SetTooltipE(tooltip string) error {
 	if err := wt.setTooltip(tooltip); err != nil {
-		log.Printf("systray error: unable to set tooltip: %s\n", err)
-		return
+		return fmt.Errorf("unable to set tooltip: %w", err)
 	}
+	return nil
 }
 
 func addOrUpdateMenuItem(item *MenuItem) {
-	err := wt.addOrUpdateMenuItem(uint32(item.id), item.parentId(), item.title, item.disabled, item.checked)
+	state := item.state.Load()
+	err := wt.addOrUpdateMenuItem(uint32(item.id), item.parentId(), state.title, state.disabled, state.checked)
 	if err != nil {
-		log.Printf("systray error: unable to addOrUpdateMenuItem: %s\n", err)
+		logger().Error("unable to add or update menu item", "item", item.id, "err", err)
 		return
 	}
 }
@@ -1065,10 +1106,10 @@ func (item *MenuItem) SetTemplateIcon(templateIconBytes []byte, regularIconBytes
 	item.SetIcon(regularIconBytes)
 }
 
-func addSeparator(id uint32, parent uint32) {
+func (*Tray) addSeparator(id uint32, parent uint32) {
 	err := wt.addSeparatorMenuItem(id, parent)
 	if err != nil {
-		log.Printf("systray error: unable to addSeparator: %s\n", err)
+		logger().Error("unable to add separator", "item", id, "err", err)
 		return
 	}
 }
@@ -1076,7 +1117,7 @@ func addSeparator(id uint32, parent uint32) {
 func hideMenuItem(item *MenuItem) {
 	err := wt.hideMenuItem(uint32(item.id), item.parentId())
 	if err != nil {
-		log.Printf("systray error: unable to hideMenuItem: %s\n", err)
+		logger().Error("unable to hide menu item", "item", item.id, "err", err)
 		return
 	}
 }
@@ -1084,7 +1125,7 @@ func hideMenuItem(item *MenuItem) {
 func removeMenuItem(item *MenuItem) {
 	err := wt.removeMenuItem(uint32(item.id), item.parentId())
 	if err != nil {
-		log.Printf("systray error: unable to removeMenuItem: %s\n", err)
+		logger().Error("unable to remove menu item", "item", item.id, "err", err)
 		return
 	}
 }
@@ -1093,7 +1134,7 @@ func showMenuItem(item *MenuItem) {
 	addOrUpdateMenuItem(item)
 }
 
-func resetMenu() {
+func (*Tray) resetMenu() {
 	_, _, _ = pDestroyMenu.Call(uintptr(wt.menus[0]))
 	wt.visibleItems = make(map[uint32][]uint32)
 	wt.menus = make(map[uint32]windows.Handle)
@@ -1101,3 +1142,96 @@ func resetMenu() {
 	wt.menuItemIcons = make(map[uint32]windows.Handle)
 	wt.createMenu()
 }
+
+func (t *Tray) setIconImage(img image.Image) error {
+	iconBytes, err := encodeIcon(img)
+	if err != nil {
+		return err
+	}
+	return t.setIcon(iconBytes)
+}
+
+// setAttentionIconImage does nothing, the attention icon is only available on Linux.
+func (*Tray) setAttentionIconImage(image.Image) error {
+	return nil
+}
+
+// setStatus does nothing, the status is only available on Linux.
+func (*Tray) setStatus(Status) error {
+	return nil
+}
+
+// encodeIcon encodes the image as ICO with the single PNG image, LoadImage accepts it since Vista
+func encodeIcon(img image.Image) ([]byte, error) {
+	pngBytes, err := encodePNG(img)
+	if err != nil {
+		return nil, err
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if w > 256 || h > 256 {
+		return nil, fmt.Errorf("%w: the icon is larger than 256x256", ErrBadIcon)
+	}
+	const headerSize = 6 + 16
+	data := make([]byte, headerSize, headerSize+len(pngBytes))
+	binary.LittleEndian.PutUint16(data[2:], 1) // icon type
+	binary.LittleEndian.PutUint16(data[4:], 1) // image count
+	// the size of 256 is written as 0
+	data[6], data[7] = byte(w), byte(h)
+	binary.LittleEndian.PutUint16(data[10:], 1)  // color planes
+	binary.LittleEndian.PutUint16(data[12:], 32) // bits per pixel
+	binary.LittleEndian.PutUint32(data[14:], uint32(len(pngBytes)))
+	binary.LittleEndian.PutUint32(data[18:], headerSize)
+	return append(data, pngBytes...), nil
+}
+
+func iconCacheStats() IconCacheStats {
+	return IconCacheStats{}
+}
+
+// iconFrame is the encoded frame of the icon animation
+type iconFrame = []byte
+
+func decodeFrame(data []byte) (iconFrame, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%w: empty icon", ErrBadIcon)
+	}
+	return data, nil
+}
+
+func imageFrame(img image.Image) (iconFrame, error) {
+	return encodeIcon(img)
+}
+
+func (t *Tray) showFrame(frame iconFrame) error {
+	return t.setIcon(frame)
+}
+
+// passive is always false, the status is only available on Linux
+func (*Tray) passive() bool {
+	return false
+}
+
+// setBadge does nothing, the badge is only available on Linux.
+func (*Tray) setBadge(int) error {
+	return nil
+}
+
+// setBadgeStyle does nothing, the badge is only available on Linux.
+func (*Tray) setBadgeStyle(BadgeStyle) error {
+	return nil
+}
+
+// setProgress does nothing, the progress indicator is only available on Linux.
+func (*Tray) setProgress(float64) error {
+	return nil
+}
+
+// clearProgress does nothing, the progress indicator is only available on Linux.
+func (*Tray) clearProgress() error {
+	return nil
+}
+
+// setProgressStyle does nothing, the progress indicator is only available on Linux.
+func (*Tray) setProgressStyle(ProgressStyle) error {
+	return nil
+}